@@ -1,6 +1,8 @@
 package client
 
 import (
+	"context"
+
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -22,7 +24,7 @@ func getClientSet() (*kubernetes.Clientset, error) {
 
 func (client *Client) getNodes() error {
 
-	nodes, err := client.CoreV1().Nodes().List(v1.ListOptions{})
+	nodes, err := client.CoreV1().Nodes().List(context.TODO(), v1.ListOptions{})
 	if err != nil {
 		return err
 	}
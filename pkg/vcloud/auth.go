@@ -0,0 +1,115 @@
+package vcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+)
+
+const (
+	// AuthMethodPassword logs in with user and password, this is the default
+	AuthMethodPassword = "password"
+	// AuthMethodAPIToken exchanges a vCloud API token (a refresh token) for a session
+	AuthMethodAPIToken = "apiToken"
+	// AuthMethodBearerToken uses a pre-issued bearer token as it is
+	AuthMethodBearerToken = "bearerToken"
+
+	bearerAuthHeader = "Authorization"
+)
+
+// oauthToken is the answer of the vCloud OAuth token endpoint
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// authMethod returns the configured auth method, password if none was selected
+func (v *vCloud) authMethod() string {
+	if v.cfg.AuthMethod == "" {
+		return AuthMethodPassword
+	}
+	return v.cfg.AuthMethod
+}
+
+// authenticate logs the client in with the configured auth method. It returns how long the session is valid
+// if vCloud tells us, zero otherwise.
+func (v *vCloud) authenticate(ctx context.Context, client *govcd.VCDClient) (time.Duration, error) {
+	c := v.credentials()
+	switch v.authMethod() {
+	case AuthMethodPassword:
+		return 0, callWithContext(ctx, func() error {
+			return client.Authenticate(c.User, c.Password, v.cfg.Org)
+		})
+	case AuthMethodAPIToken:
+		token, err := exchangeAPIToken(ctx, client, v.cfg.Org, c.APIToken)
+		if err != nil {
+			return 0, err
+		}
+		err = callWithContext(ctx, func() error {
+			return client.SetToken(v.cfg.Org, bearerAuthHeader, "Bearer "+token.AccessToken)
+		})
+		return time.Duration(token.ExpiresIn) * time.Second, err
+	case AuthMethodBearerToken:
+		return 0, callWithContext(ctx, func() error {
+			return client.SetToken(v.cfg.Org, bearerAuthHeader, "Bearer "+c.BearerToken)
+		})
+	default:
+		return 0, fmt.Errorf("unknown authMethod %q, must be one of %s, %s or %s", v.cfg.AuthMethod, AuthMethodPassword, AuthMethodAPIToken, AuthMethodBearerToken)
+	}
+}
+
+// ownsSession reports whether sessions are created by the controller and may be logged out.
+// Pre-issued bearer tokens belong to whoever issued them.
+func (v *vCloud) ownsSession() bool {
+	return v.authMethod() != AuthMethodBearerToken
+}
+
+// exchangeAPIToken trades an API token for an access token at the OAuth endpoint of the organization
+func exchangeAPIToken(ctx context.Context, client *govcd.VCDClient, org string, apiToken string) (*oauthToken, error) {
+	endpoint := url.URL{Scheme: client.Client.VCDHREF.Scheme, Host: client.Client.VCDHREF.Host}
+	if strings.EqualFold(org, "system") {
+		endpoint.Path = "/oauth/provider/token"
+	} else {
+		endpoint.Path = "/oauth/tenant/" + url.PathEscape(org) + "/token"
+	}
+
+	form := url.Values{"grant_type": {"refresh_token"}, "refresh_token": {apiToken}}
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to build token request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Client.Http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request access token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read access token: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API Error: %d: unable to exchange API token: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token oauthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("unable to parse access token: %s", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+	return &token, nil
+}
@@ -0,0 +1,154 @@
+package vcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// unmarshalStrict decodes the cloud-config and rejects keys that do not exist in Config,
+// so typos like "gateway" instead of "edgeGateway" fail at startup
+func unmarshalStrict(data []byte, cfg *Config) error {
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(cfg)
+}
+
+// setDefaults fills every optional field that was left empty
+func (cfg *Config) setDefaults() {
+	if cfg.AuthMethod == "" {
+		cfg.AuthMethod = AuthMethodPassword
+	}
+	if cfg.SessionTTL.Duration == 0 {
+		cfg.SessionTTL.Duration = maxConnectionValidity
+	}
+	if cfg.GarbageCollector.Interval.Duration == 0 {
+		cfg.GarbageCollector.Interval.Duration = defaultGarbageCollectionInterval
+	}
+	if cfg.Credentials.SecretName != "" && cfg.Credentials.SecretNamespace == "" {
+		cfg.Credentials.SecretNamespace = defaultCredentialsNamespace
+	}
+	if cfg.Credentials.ReloadInterval.Duration == 0 {
+		cfg.Credentials.ReloadInterval.Duration = defaultCredentialsReloadInterval
+	}
+	if cfg.Timeouts.Request.Duration == 0 {
+		cfg.Timeouts.Request.Duration = defaultRequestTimeout
+	}
+	if cfg.Timeouts.Operation.Duration == 0 {
+		cfg.Timeouts.Operation.Duration = defaultOperationTimeout
+	}
+}
+
+// Validate checks the cloud-config and returns all problems at once
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Href == "" {
+		errs = append(errs, fmt.Errorf("href is required, e.g. https://vcloud.example.com/api"))
+	} else if u, err := url.ParseRequestURI(cfg.Href); err != nil {
+		errs = append(errs, fmt.Errorf("href %q is not a valid URL: %s", cfg.Href, err))
+	} else if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("href %q must be an absolute http(s) URL, e.g. https://vcloud.example.com/api", cfg.Href))
+	} else if !strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), "/api") {
+		errs = append(errs, fmt.Errorf("href %q must point to the API endpoint ending in /api", cfg.Href))
+	}
+	if cfg.Org == "" {
+		errs = append(errs, fmt.Errorf("org is required"))
+	}
+	if cfg.VDC == "" {
+		errs = append(errs, fmt.Errorf("vdc is required"))
+	}
+	if cfg.EdgeGateway == "" {
+		errs = append(errs, fmt.Errorf("edgeGateway is required"))
+	}
+
+	//NOTE: Credentials read from a path or Secret are only known at runtime
+	externalCredentials := cfg.Credentials.Path != "" || cfg.Credentials.SecretName != ""
+	switch cfg.AuthMethod {
+	case AuthMethodPassword:
+		if !externalCredentials && (cfg.User == "" || cfg.Password == "") {
+			errs = append(errs, fmt.Errorf("authMethod %s requires user and password or a credentials source", AuthMethodPassword))
+		}
+	case AuthMethodAPIToken:
+		if !externalCredentials && cfg.APIToken == "" {
+			errs = append(errs, fmt.Errorf("authMethod %s requires apiToken or a credentials source", AuthMethodAPIToken))
+		}
+	case AuthMethodBearerToken:
+		if !externalCredentials && cfg.BearerToken == "" {
+			errs = append(errs, fmt.Errorf("authMethod %s requires bearerToken or a credentials source", AuthMethodBearerToken))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("authMethod %q is unknown, must be one of %s, %s or %s", cfg.AuthMethod, AuthMethodPassword, AuthMethodAPIToken, AuthMethodBearerToken))
+	}
+	if cfg.Credentials.SecretNamespace != "" && cfg.Credentials.SecretName == "" {
+		errs = append(errs, fmt.Errorf("credentials.secretNamespace is set without credentials.secretName"))
+	}
+
+	if _, ok := tlsVersions[cfg.TLS.MinVersion]; cfg.TLS.MinVersion != "" && !ok {
+		errs = append(errs, fmt.Errorf("tls.minVersion %q is unknown, must be one of 1.0, 1.1, 1.2 or 1.3", cfg.TLS.MinVersion))
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls.certFile and tls.keyFile must be set together"))
+	}
+	if cfg.Insecure && (cfg.TLS.CAFile != "" || cfg.TLS.CAData != "") {
+		errs = append(errs, fmt.Errorf("insecure disables certificate verification, tls.caFile and tls.caData would be ignored"))
+	}
+
+	if cfg.Proxy.URL != "" {
+		if u, err := url.Parse(cfg.Proxy.URL); err != nil {
+			errs = append(errs, fmt.Errorf("proxy.url %q is not a valid URL: %s", cfg.Proxy.URL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("proxy.url %q must be an absolute http, https or socks5 URL", cfg.Proxy.URL))
+		}
+	} else if cfg.Proxy.NoProxy != "" {
+		errs = append(errs, fmt.Errorf("proxy.noProxy is set without proxy.url"))
+	}
+
+	for _, source := range cfg.Firewall.Internal.Sources {
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			errs = append(errs, fmt.Errorf("firewall.internal.sources: %q is neither an IP address nor a CIDR", source))
+		}
+	}
+
+	if cfg.SessionTTL.Duration < 0 {
+		errs = append(errs, fmt.Errorf("sessionTTL must not be negative"))
+	}
+	if cfg.GarbageCollector.Interval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("garbageCollector.interval must not be negative"))
+	}
+	if cfg.Credentials.ReloadInterval.Duration < 0 {
+		errs = append(errs, fmt.Errorf("credentials.reloadInterval must not be negative"))
+	}
+	if cfg.Timeouts.Request.Duration < 0 || cfg.Timeouts.Operation.Duration < 0 {
+		errs = append(errs, fmt.Errorf("timeouts must not be negative"))
+	} else if cfg.Timeouts.Operation.Duration < cfg.Timeouts.Request.Duration {
+		errs = append(errs, fmt.Errorf("timeouts.operation (%s) must not be shorter than timeouts.request (%s)", cfg.Timeouts.Operation, cfg.Timeouts.Request))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// preflight checks that vCloud can be reached with the configured credentials and the edge gateway exists
+func (v *vCloud) preflight() error {
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.Timeouts.Operation.Duration)
+	defer cancel()
+
+	if _, err := v.getClient(ctx, false); err != nil {
+		return fmt.Errorf("unable to log into vCloud at %s as %q: %s", v.cfg.Href, v.credentials().User, err)
+	}
+	if _, err := v.getEdgeGateway(ctx, v.cfg.Org, v.cfg.VDC, v.cfg.EdgeGateway); err != nil {
+		return fmt.Errorf("unable to find edge gateway %q in org %q and vdc %q: %s", v.cfg.EdgeGateway, v.cfg.Org, v.cfg.VDC, err)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package vcloud
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validConfig = `
+href: https://vcloud.example.com/api
+org: org1
+vdc: vdc1
+edgeGateway: edge1
+user: admin
+password: secret
+`
+
+// mapLookup returns a lookup for applyEnvOverrides backed by env instead of the process environment
+func mapLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+// parseConfig runs the same steps as ReadConfig with env as the environment
+func parseConfig(data string, env map[string]string) (*Config, error) {
+	var cfg Config
+	if err := unmarshalStrict([]byte(data), &cfg); err != nil {
+		return nil, err
+	}
+	if err := applyEnvOverrides(&cfg, mapLookup(env)); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// errors are substrings that all have to be part of the error, none means the config is valid
+		errors []string
+	}{
+		{
+			name:   "valid",
+			config: validConfig,
+		},
+		{
+			name:   "unknown key",
+			config: validConfig + "gateway: edge1\n",
+			errors: []string{`unknown field "gateway"`},
+		},
+		{
+			name:   "unknown nested key",
+			config: validConfig + "garbageCollector:\n  dryRunOnly: true\n",
+			errors: []string{`unknown field "dryRunOnly"`},
+		},
+		{
+			name:   "invalid duration",
+			config: validConfig + "sessionTTL: 10 minutes\n",
+			errors: []string{"10 minutes"},
+		},
+		{
+			name:   "duration without quotes",
+			config: validConfig + "sessionTTL: 600\n",
+			errors: []string{"invalid duration 600"},
+		},
+		{
+			name:   "invalid bool",
+			config: validConfig + "insecure: maybe\n",
+			errors: []string{"insecure"},
+		},
+		{
+			name:   "missing required fields",
+			config: "user: admin\npassword: secret\n",
+			errors: []string{"href is required", "org is required", "vdc is required", "edgeGateway is required"},
+		},
+		{
+			name:   "href without /api",
+			config: strings.Replace(validConfig, "vcloud.example.com/api", "vcloud.example.com", 1),
+			errors: []string{"must point to the API endpoint ending in /api"},
+		},
+		{
+			name:   "relative href",
+			config: strings.Replace(validConfig, "https://vcloud.example.com/api", "/api", 1),
+			errors: []string{"must be an absolute http(s) URL"},
+		},
+		{
+			name:   "unknown auth method",
+			config: validConfig + "authMethod: kerberos\n",
+			errors: []string{`authMethod "kerberos" is unknown`},
+		},
+		{
+			name:   "api token missing",
+			config: validConfig + "authMethod: apiToken\n",
+			errors: []string{"authMethod apiToken requires apiToken"},
+		},
+		{
+			name:   "api token from credentials path",
+			config: validConfig + "authMethod: apiToken\ncredentials:\n  path: /etc/vcloud\n",
+		},
+		{
+			name:   "password missing",
+			config: strings.Replace(validConfig, "password: secret\n", "", 1),
+			errors: []string{"authMethod password requires user and password"},
+		},
+		{
+			name:   "secret namespace without name",
+			config: validConfig + "credentials:\n  secretNamespace: kube-system\n",
+			errors: []string{"credentials.secretNamespace is set without credentials.secretName"},
+		},
+		{
+			name:   "unknown tls version",
+			config: validConfig + "tls:\n  minVersion: \"1.4\"\n",
+			errors: []string{`tls.minVersion "1.4" is unknown`},
+		},
+		{
+			name:   "client certificate without key",
+			config: validConfig + "tls:\n  certFile: /etc/vcloud/tls.crt\n",
+			errors: []string{"tls.certFile and tls.keyFile must be set together"},
+		},
+		{
+			name:   "insecure with ca",
+			config: validConfig + "insecure: true\ntls:\n  caFile: /etc/vcloud/ca.crt\n",
+			errors: []string{"insecure disables certificate verification"},
+		},
+		{
+			name:   "unsupported proxy scheme",
+			config: validConfig + "proxy:\n  url: ftp://proxy.example.com\n",
+			errors: []string{"must be an absolute http, https or socks5 URL"},
+		},
+		{
+			name:   "no proxy without proxy",
+			config: validConfig + "proxy:\n  noProxy: example.com\n",
+			errors: []string{"proxy.noProxy is set without proxy.url"},
+		},
+		{
+			name:   "invalid firewall source",
+			config: validConfig + "firewall:\n  internal:\n    sources: [10.0.0.0/8, 192.168.1.1, internal]\n",
+			errors: []string{`"internal" is neither an IP address nor a CIDR`},
+		},
+		{
+			name:   "negative duration",
+			config: validConfig + "garbageCollector:\n  interval: -1m\n",
+			errors: []string{"garbageCollector.interval must not be negative"},
+		},
+		{
+			name:   "operation shorter than request",
+			config: validConfig + "timeouts:\n  request: 2m\n  operation: 1m\n",
+			errors: []string{"timeouts.operation (1m0s) must not be shorter than timeouts.request (2m0s)"},
+		},
+		{
+			name:   "operation shorter than default request",
+			config: validConfig + "timeouts:\n  operation: 30s\n",
+			errors: []string{"timeouts.operation (30s) must not be shorter than timeouts.request (1m0s)"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseConfig(test.config, nil)
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Fatalf("expected the config to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %q, got none", test.errors)
+			}
+			for _, expected := range test.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected error to contain %q, got %s", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := parseConfig(validConfig, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AuthMethod != AuthMethodPassword {
+		t.Errorf("expected authMethod %s, got %s", AuthMethodPassword, cfg.AuthMethod)
+	}
+	if cfg.SessionTTL.Duration != maxConnectionValidity {
+		t.Errorf("expected sessionTTL %s, got %s", maxConnectionValidity, cfg.SessionTTL)
+	}
+	if cfg.Timeouts.Request.Duration != defaultRequestTimeout || cfg.Timeouts.Operation.Duration != defaultOperationTimeout {
+		t.Errorf("expected timeouts %s and %s, got %s and %s", defaultRequestTimeout, defaultOperationTimeout, cfg.Timeouts.Request, cfg.Timeouts.Operation)
+	}
+	if cfg.ClusterName != "" {
+		t.Errorf("expected no default clusterName, got %s", cfg.ClusterName)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"href":           "HREF",
+		"edgeGateway":    "EDGE_GATEWAY",
+		"sessionTTL":     "SESSION_TTL",
+		"apiToken":       "API_TOKEN",
+		"caData":         "CA_DATA",
+		"VDCNetworkName": "VDC_NETWORK_NAME",
+	}
+	for key, expected := range tests {
+		if name := envName(key); name != expected {
+			t.Errorf("envName(%q) = %q, expected %q", key, name, expected)
+		}
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		env    map[string]string
+		// check inspects the parsed config, it is not called if errors is set
+		check  func(t *testing.T, cfg *Config)
+		errors []string
+	}{
+		{
+			name:   "environment takes precedence over the file",
+			config: validConfig,
+			env:    map[string]string{"VCLOUD_ORG": "org2", "VCLOUD_EDGE_GATEWAY": "edge2"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Org != "org2" || cfg.EdgeGateway != "edge2" {
+					t.Errorf("expected org2 and edge2, got %s and %s", cfg.Org, cfg.EdgeGateway)
+				}
+				if cfg.VDC != "vdc1" {
+					t.Errorf("expected vdc1 from the file, got %s", cfg.VDC)
+				}
+			},
+		},
+		{
+			name:   "empty value overrides the file",
+			config: validConfig + "clusterName: prod\n",
+			env:    map[string]string{"VCLOUD_CLUSTER_NAME": ""},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ClusterName != "" {
+					t.Errorf("expected an empty clusterName, got %s", cfg.ClusterName)
+				}
+			},
+		},
+		{
+			name:   "environment fills required fields",
+			config: "user: admin\n",
+			env: map[string]string{
+				"VCLOUD_HREF":         "https://vcloud.example.com/api",
+				"VCLOUD_ORG":          "org1",
+				"VCLOUD_VDC":          "vdc1",
+				"VCLOUD_EDGE_GATEWAY": "edge1",
+				"VCLOUD_PASSWORD":     "secret",
+			},
+		},
+		{
+			name:   "nested fields and durations",
+			config: validConfig + "garbageCollector:\n  interval: 5m\n",
+			env: map[string]string{
+				"VCLOUD_GARBAGE_COLLECTOR_INTERVAL": "90s",
+				"VCLOUD_GARBAGE_COLLECTOR_DRY_RUN":  "true",
+				"VCLOUD_TIMEOUTS_REQUEST":           "30s",
+				"VCLOUD_SESSION_TTL":                "1h",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.GarbageCollector.Interval.Duration != 90*time.Second {
+					t.Errorf("expected interval 90s, got %s", cfg.GarbageCollector.Interval)
+				}
+				if !cfg.GarbageCollector.DryRun {
+					t.Errorf("expected dryRun")
+				}
+				if cfg.Timeouts.Request.Duration != 30*time.Second {
+					t.Errorf("expected request timeout 30s, got %s", cfg.Timeouts.Request)
+				}
+				if cfg.SessionTTL.Duration != time.Hour {
+					t.Errorf("expected sessionTTL 1h, got %s", cfg.SessionTTL)
+				}
+			},
+		},
+		{
+			name:   "bools",
+			config: validConfig + "insecure: true\nfirewall:\n  logging: true\n",
+			env:    map[string]string{"VCLOUD_INSECURE": "0", "VCLOUD_FIREWALL_LOGGING": "FALSE"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Insecure || cfg.Firewall.Logging {
+					t.Errorf("expected insecure and firewall.logging to be disabled")
+				}
+			},
+		},
+		{
+			name:   "comma separated lists",
+			config: validConfig + "firewall:\n  internal:\n    sources: [10.0.0.0/8]\n",
+			env:    map[string]string{"VCLOUD_FIREWALL_INTERNAL_SOURCES": " 192.168.0.0/16, ,172.16.0.1 "},
+			check: func(t *testing.T, cfg *Config) {
+				expected := []string{"192.168.0.0/16", "172.16.0.1"}
+				if !reflect.DeepEqual(cfg.Firewall.Internal.Sources, expected) {
+					t.Errorf("expected sources %q, got %q", expected, cfg.Firewall.Internal.Sources)
+				}
+			},
+		},
+		{
+			name:   "env tags replace the derived name",
+			config: validConfig,
+			env: map[string]string{
+				"VCLOUD_VDC_NETWORK_NAME":  "net1",
+				"VCLOUD_VDC_NETWORK_IPNET": "10.13.37.0/24",
+				"VCLOUD_NETWORK_NAME":      "ignored",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Network.Name != "net1" || cfg.Network.IPNet != "10.13.37.0/24" {
+					t.Errorf("expected net1 and 10.13.37.0/24, got %s and %s", cfg.Network.Name, cfg.Network.IPNet)
+				}
+			},
+		},
+		{
+			name:   "variables without prefix are ignored",
+			config: validConfig,
+			env:    map[string]string{"ORG": "org2", "vcloud_org": "org3"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Org != "org1" {
+					t.Errorf("expected org1, got %s", cfg.Org)
+				}
+			},
+		},
+		{
+			name:   "overrides are validated",
+			config: validConfig,
+			env:    map[string]string{"VCLOUD_AUTH_METHOD": "kerberos"},
+			errors: []string{`authMethod "kerberos" is unknown`},
+		},
+		{
+			name:   "invalid values are all reported",
+			config: validConfig,
+			env: map[string]string{
+				"VCLOUD_INSECURE":                   "maybe",
+				"VCLOUD_GARBAGE_COLLECTOR_INTERVAL": "10",
+			},
+			errors: []string{
+				"invalid value of VCLOUD_INSECURE for insecure",
+				"invalid value of VCLOUD_GARBAGE_COLLECTOR_INTERVAL for garbageCollector.interval",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, err := parseConfig(test.config, test.env)
+			if len(test.errors) > 0 {
+				if err == nil {
+					t.Fatalf("expected errors %q, got none", test.errors)
+				}
+				for _, expected := range test.errors {
+					if !strings.Contains(err.Error(), expected) {
+						t.Errorf("expected error to contain %q, got %s", expected, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected the config to be valid, got %s", err)
+			}
+			if test.check != nil {
+				test.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestEnvVariablesAreUnique(t *testing.T) {
+	seen := map[string]string{}
+	for _, variable := range envVariables(&Config{}) {
+		if !strings.HasPrefix(variable.Name, envPrefix) {
+			t.Errorf("%s of %s does not start with %s", variable.Name, variable.Field, envPrefix)
+		}
+		if field, ok := seen[variable.Name]; ok {
+			t.Errorf("%s is used by %s and %s", variable.Name, field, variable.Field)
+		}
+		seen[variable.Name] = variable.Field
+	}
+}
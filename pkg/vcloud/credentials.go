@@ -0,0 +1,276 @@
+package vcloud
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	credentialKeyUser        = "user"
+	credentialKeyPassword    = "password"
+	credentialKeyAPIToken    = "apiToken"
+	credentialKeyBearerToken = "bearerToken"
+
+	defaultCredentialsNamespace      = "kube-system"
+	defaultCredentialsReloadInterval = time.Minute
+)
+
+// credentials are the secrets used to log into vCloud
+type credentials struct {
+	User        string
+	Password    string
+	APIToken    string
+	BearerToken string
+}
+
+// credentialStore holds the current credentials, they change when the configured sources rotate
+type credentialStore struct {
+	current credentials
+	sync.RWMutex
+}
+
+func (s *credentialStore) get() credentials {
+	s.RLock()
+	defer s.RUnlock()
+	return s.current
+}
+
+// set stores c and reports whether it differs from the previous credentials
+func (s *credentialStore) set(c credentials) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.current == c {
+		return false
+	}
+	s.current = c
+	return true
+}
+
+// credentials returns the credentials currently used to log into vCloud
+func (v *vCloud) credentials() credentials {
+	return v.credentialStore.get()
+}
+
+// inlineCredentials returns the credentials written directly into the cloud-config
+func (v *vCloud) inlineCredentials() credentials {
+	return credentials{
+		User:        v.cfg.User,
+		Password:    v.cfg.Password,
+		APIToken:    v.cfg.APIToken,
+		BearerToken: v.cfg.BearerToken,
+	}
+}
+
+// apply overrides the credentials with every non empty value of values
+func (c *credentials) apply(values map[string]string) {
+	for key, value := range values {
+		if value == "" {
+			continue
+		}
+		switch key {
+		case credentialKeyUser:
+			c.User = value
+		case credentialKeyPassword:
+			c.Password = value
+		case credentialKeyAPIToken:
+			c.APIToken = value
+		case credentialKeyBearerToken:
+			c.BearerToken = value
+		}
+	}
+}
+
+// readCredentialsPath reads credentials from a directory with one file per key, as mounted for a Secret volume,
+// or from a single YAML file holding the keys
+func readCredentialsPath(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials from %s: %s", path, err)
+	}
+
+	values := map[string]string{}
+	if !info.IsDir() {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials file %s: %s", path, err)
+		}
+		if err := yaml.Unmarshal(content, &values); err != nil {
+			return nil, fmt.Errorf("unable to parse credentials file %s: %s", path, err)
+		}
+		return values, nil
+	}
+
+	for _, key := range []string{credentialKeyUser, credentialKeyPassword, credentialKeyAPIToken, credentialKeyBearerToken} {
+		content, err := ioutil.ReadFile(filepath.Join(path, key))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credential %s from %s: %s", key, path, err)
+		}
+		values[key] = strings.TrimSpace(string(content))
+	}
+	return values, nil
+}
+
+// credentialsSecretNamespace returns the namespace of the credentials Secret
+func (v *vCloud) credentialsSecretNamespace() string {
+	if v.cfg.Credentials.SecretNamespace == "" {
+		return defaultCredentialsNamespace
+	}
+	return v.cfg.Credentials.SecretNamespace
+}
+
+// readCredentialsSecret reads credentials from the configured Kubernetes Secret. Once the Secret is watched
+// it is taken from the cache of the watch, otherwise it is read from the API server.
+func (v *vCloud) readCredentialsSecret() (map[string]string, error) {
+	namespace, name := v.credentialsSecretNamespace(), v.cfg.Credentials.SecretName
+	var secret *corev1.Secret
+	if v.credentialsSecrets != nil {
+		obj, exists, err := v.credentialsSecrets.GetByKey(namespace + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials secret %s/%s: %s", namespace, name, err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("unable to read credentials secret %s/%s: not found", namespace, name)
+		}
+		secret = obj.(*corev1.Secret)
+	} else {
+		var err error
+		secret, err = v.kubeClient.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read credentials secret %s/%s: %s", namespace, name, err)
+		}
+	}
+	values := map[string]string{}
+	for key, value := range secret.Data {
+		values[key] = strings.TrimSpace(string(value))
+	}
+	return values, nil
+}
+
+// newCredentialsSecretInformer returns an informer that only watches the credentials Secret
+func (v *vCloud) newCredentialsSecretInformer(handler cache.ResourceEventHandler) (cache.Store, cache.Controller) {
+	namespace := v.credentialsSecretNamespace()
+	selector := fields.OneTermEqualSelector("metadata.name", v.cfg.Credentials.SecretName).String()
+	listWatch := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return v.kubeClient.CoreV1().Secrets(namespace).List(context.TODO(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return v.kubeClient.CoreV1().Secrets(namespace).Watch(context.TODO(), options)
+		},
+	}
+	return cache.NewInformer(listWatch, &corev1.Secret{}, 0, handler)
+}
+
+// loadCredentials reads all configured credential sources. Values from the path override the cloud-config,
+// values from the Secret override both. Sessions of replaced credentials are dropped.
+func (v *vCloud) loadCredentials() error {
+	c := v.inlineCredentials()
+	if v.cfg.Credentials.Path != "" {
+		values, err := readCredentialsPath(v.cfg.Credentials.Path)
+		if err != nil {
+			return err
+		}
+		c.apply(values)
+	}
+	if v.cfg.Credentials.SecretName != "" {
+		if v.kubeClient == nil {
+			return fmt.Errorf("unable to read credentials secret %s before the cloud provider is initialized", v.cfg.Credentials.SecretName)
+		}
+		values, err := v.readCredentialsSecret()
+		if err != nil {
+			return err
+		}
+		c.apply(values)
+	}
+
+	if v.credentialStore.set(c) {
+		klog.V(1).Info("vCloud credentials changed, dropping cached sessions")
+		v.dropSessions()
+	}
+	return nil
+}
+
+// dropSessions removes all cached sessions and objects resolved with them, so the next request logs in again
+func (v *vCloud) dropSessions() {
+	cachedVCDClients.Lock()
+	sessions := make([]*govcd.VCDClient, 0, len(cachedVCDClients.conMap))
+	for _, connection := range cachedVCDClients.conMap {
+		sessions = append(sessions, connection.connection)
+	}
+	cachedVCDClients.conMap = make(map[string]cachedConnection)
+	cachedVCDClients.Unlock()
+	cachedVCDObjects.invalidate("credentials changed")
+
+	if !v.ownsSession() {
+		return
+	}
+	for _, session := range sessions {
+		logout(session)
+	}
+}
+
+// watchCredentials reloads the credentials whenever the Secret changes until stop is closed. All sources are
+// also reloaded every interval, files have no watch and a missed event must not keep old credentials forever.
+func (v *vCloud) watchCredentials(interval time.Duration, stop <-chan struct{}) {
+	klog.V(1).Infof("Watching vCloud credentials, reloading them at least every %s", interval)
+	changed := make(chan struct{}, 1)
+	if v.cfg.Credentials.SecretName != "" {
+		notify := func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+		store, controller := v.newCredentialsSecretInformer(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(interface{}) { notify() },
+			UpdateFunc: func(interface{}, interface{}) { notify() },
+			DeleteFunc: func(interface{}) { notify() },
+		})
+		go controller.Run(stop)
+		if !cache.WaitForCacheSync(stop, controller.HasSynced) {
+			return
+		}
+		//NOTE: Only this goroutine loads credentials from now on, the field is not read concurrently
+		v.credentialsSecrets = store
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+		if err := v.loadCredentials(); err != nil {
+			klog.Errorf("reloading vCloud credentials failed: %s", err)
+		}
+	}
+}
+
+// hasCredentialSources reports whether credentials are read from outside the cloud-config
+func (v *vCloud) hasCredentialSources() bool {
+	return v.cfg.Credentials.Path != "" || v.cfg.Credentials.SecretName != ""
+}
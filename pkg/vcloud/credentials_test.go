@@ -0,0 +1,55 @@
+package vcloud
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWatchCredentials(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "vcloud-credentials", Namespace: "kube-system"},
+		Data:       map[string][]byte{credentialKeyUser: []byte("admin"), credentialKeyPassword: []byte("old")},
+	}
+	kubeClient := fake.NewSimpleClientset(secret)
+	v := &vCloud{
+		cfg:             &Config{Credentials: CredentialsConfig{SecretName: "vcloud-credentials"}},
+		credentialStore: &credentialStore{},
+		kubeClient:      kubeClient,
+	}
+	if err := v.loadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	//NOTE: The interval is far longer than the test, a change must be picked up by the watch
+	go v.watchCredentials(time.Hour, stop)
+
+	rotated := secret.DeepCopy()
+	rotated.Data[credentialKeyPassword] = []byte("new\n")
+	if _, err := kubeClient.CoreV1().Secrets("kube-system").Update(context.TODO(), rotated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return v.credentials().Password == "new", nil
+	})
+	if err != nil {
+		t.Fatalf("expected the rotated password to be loaded, got %q", v.credentials().Password)
+	}
+
+	gets := 0
+	for _, action := range kubeClient.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "secrets" {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("expected the Secret to be read once before it is watched, got %d reads", gets)
+	}
+}
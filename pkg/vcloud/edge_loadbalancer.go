@@ -0,0 +1,530 @@
+package vcloud
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"k8s.io/klog"
+)
+
+// edgeLoadBalancerConfig mirrors the parts of the NSX-V load balancer configuration we work with.
+// It is returned by a single GET on the loadbalancer/config endpoint of the edge.
+type edgeLoadBalancerConfig struct {
+	XMLName        xml.Name                 `xml:"loadBalancer"`
+	VirtualServers []*types.LbVirtualServer `xml:"virtualServer"`
+	Pools          []*types.LbPool          `xml:"pool"`
+	AppProfiles    []*types.LbAppProfile    `xml:"applicationProfile"`
+}
+
+// edgeNatConfig mirrors the NAT configuration of the edge. govcd only reads single NAT rules,
+// the complete list is returned by a GET on the nat/config endpoint.
+type edgeNatConfig struct {
+	XMLName xml.Name             `xml:"nat"`
+	Rules   []*types.EdgeNatRule `xml:"natRules>natRule"`
+}
+
+// edgeNatRules wraps the rules created by a POST on the nat/config/rules endpoint
+type edgeNatRules struct {
+	XMLName xml.Name             `xml:"natRules"`
+	Rules   []*types.EdgeNatRule `xml:"natRule"`
+}
+
+// edgeLoadBalancer holds the load balancer configuration of the edge for the duration of one reconcile.
+// The configuration is read once, changes are written per object and applied to the local copy,
+// so a reconcile only issues the requests that are really needed.
+type edgeLoadBalancer struct {
+	// ctx bounds how long changes wait for the edge lock and how long transient errors are retried
+	ctx          context.Context
+	loadBalancer *LB
+	// objects holds the resolved edge gateway, govcd calls get a gateway of their own from it
+	objects *resolvedObjects
+	session *govcd.VCDClient
+	baseURL string
+	// edgeWrites is the number of changes to the edge when the configuration was read
+	edgeWrites uint64
+
+	VirtualServers []*types.LbVirtualServer
+	Pools          []*types.LbPool
+	AppProfiles    []*types.LbAppProfile
+
+	firewallRules     []*types.EdgeFirewallRule
+	firewallRulesRead bool
+	natRules          []*types.EdgeNatRule
+	natRulesRead      bool
+	// requests counts the vCloud API requests issued through this edgeLoadBalancer
+	requests int
+}
+
+// readEdgeLoadBalancer resolves the edge gateway and reads its complete load balancer configuration
+func (loadBalancer *LB) readEdgeLoadBalancer(ctx context.Context) (*edgeLoadBalancer, error) {
+	objects, err := loadBalancer.resolveObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+	baseURL, err := proxiedEdgeURL(objects.newEdgeGateway())
+	if err != nil {
+		return nil, err
+	}
+
+	edge := &edgeLoadBalancer{ctx: ctx, loadBalancer: loadBalancer, objects: objects, session: objects.client, baseURL: baseURL,
+		edgeWrites: atomic.LoadUint64(&loadBalancer.edgeWrites)}
+
+	var config edgeLoadBalancerConfig
+	err = edge.do(http.MethodGet, types.LbConfigPath, "unable to read load balancer configuration", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	edge.VirtualServers = config.VirtualServers
+	edge.Pools = config.Pools
+	edge.AppProfiles = config.AppProfiles
+
+	return edge, nil
+}
+
+// VirtualServerAddresses returns the addresses of all vServers currently on the edge. The configuration is only read
+// again if other operations changed the edge since this edgeLoadBalancer was read, their vServers are not in the copy.
+func (edge *edgeLoadBalancer) VirtualServerAddresses() ([]string, error) {
+	vservers := edge.VirtualServers
+	if atomic.LoadUint64(&edge.loadBalancer.edgeWrites) != edge.edgeWrites {
+		var config edgeLoadBalancerConfig
+		err := edge.do(http.MethodGet, types.LbConfigPath, "unable to read load balancer configuration", nil, &config)
+		if err != nil {
+			return nil, err
+		}
+		vservers = config.VirtualServers
+	}
+	var addresses []string
+	for _, vserver := range vservers {
+		addresses = append(addresses, vserver.IpAddress)
+	}
+	return addresses, nil
+}
+
+// proxiedEdgeURL returns the root of the NSX API proxy for the edge gateway
+func proxiedEdgeURL(gateway *govcd.EdgeGateway) (string, error) {
+	apiEndpoint, err := url.ParseRequestURI(gateway.EdgeGateway.HREF)
+	if err != nil {
+		return "", fmt.Errorf("unable to process edge gateway URL: %s", err)
+	}
+	edgeID := strings.Split(gateway.EdgeGateway.ID, ":")
+	if len(edgeID) != 4 {
+		return "", fmt.Errorf("unable to find edge gateway id: %s", gateway.EdgeGateway.ID)
+	}
+	return apiEndpoint.Scheme + "://" + apiEndpoint.Host + "/network/edges/" + edgeID[3], nil
+}
+
+// lock serializes changes to the edge configuration, vCloud does not handle concurrent updates of an edge.
+// Every change is counted when the lock is released, so copies read before can tell they are outdated.
+func (edge *edgeLoadBalancer) lock() (func(), error) {
+	unlock, err := edge.loadBalancer.lockKey(edge.ctx, lockKindEdge, edge.objects.edge.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for lock of edge gateway %s: %s", edge.objects.edge.Name, err.Error())
+	}
+	return func() {
+		atomic.AddUint64(&edge.loadBalancer.edgeWrites, 1)
+		unlock()
+	}, nil
+}
+
+// do issues a single request against the proxied edge endpoint
+func (edge *edgeLoadBalancer) do(method string, suffix string, errorMessage string, payload interface{}, out interface{}) error {
+	_, err := edge.request(method, suffix, errorMessage, payload, out)
+	return err
+}
+
+// doWithLocation behaves like do and returns the ID of a created object taken from the Location header
+func (edge *edgeLoadBalancer) doWithLocation(method string, suffix string, errorMessage string, payload interface{}, out interface{}) (string, error) {
+	resp, err := edge.request(method, suffix, errorMessage, payload, out)
+	if err != nil {
+		return "", err
+	}
+	// Location header should look similar to: /network/edges/edge-3/loadbalancer/config/pools/pool-7
+	id := path.Base(strings.TrimSpace(resp.Header.Get("Location")))
+	if id == "." || id == "/" {
+		return "", fmt.Errorf("%s: answer of %s %s has no Location header", errorMessage, method, suffix)
+	}
+	return id, nil
+}
+
+// request issues the request, changes hold the lock of the edge
+func (edge *edgeLoadBalancer) request(method string, suffix string, errorMessage string, payload interface{}, out interface{}) (*http.Response, error) {
+	if method != http.MethodGet {
+		unlock, err := edge.lock()
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	retryFn := retryOnTransientError
+	if method == http.MethodPost {
+		retryFn = retryOnRejection
+	}
+	var resp *http.Response
+	err := retryFn(edge.ctx, edgeOperation(method, suffix), func() error {
+		return edge.withSession(func() error {
+			var err error
+			edge.requests++
+			resp, err = newRESTClient(edge.session, edge.loadBalancer.vCloud.cfg.Timeouts.Request.Duration).do(edge.ctx, method, edge.baseURL+suffix, payload, out)
+			return err
+		})
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return nil, fmt.Errorf("%s: %w", errorMessage, err)
+	}
+	return resp, nil
+}
+
+// edgeOperation names a request for metrics and logs by its method and the path without object IDs,
+// e.g. PUT /loadbalancer/config/pools/pool-7 is edge_put_loadbalancer_config_pools
+func edgeOperation(method string, suffix string) string {
+	parts := []string{"edge", strings.ToLower(method)}
+	for _, segment := range strings.Split(suffix, "/") {
+		if segment != "" && !strings.ContainsAny(segment, "0123456789") {
+			parts = append(parts, strings.ToLower(segment))
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// withSession runs fn and repeats it once with a new session if vCloud rejected the current one
+func (edge *edgeLoadBalancer) withSession(fn func() error) error {
+	err := fn()
+	if !isUnauthorizedError(err) {
+		return err
+	}
+	session, err := edge.loadBalancer.vCloud.renewClient(edge.ctx, edge.session)
+	if err != nil {
+		return err
+	}
+	//NOTE: The gateway keeps a reference to the client it was resolved with
+	objects, err := edge.loadBalancer.resolveObjects(edge.ctx)
+	if err != nil {
+		return err
+	}
+	edge.session = session
+	edge.objects = objects
+	return fn()
+}
+
+// Requests returns the number of vCloud API requests issued so far
+func (edge *edgeLoadBalancer) Requests() int {
+	return edge.requests
+}
+
+func (edge *edgeLoadBalancer) AppProfileByName(name string) (*types.LbAppProfile, error) {
+	for _, profile := range edge.AppProfiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return nil, fmt.Errorf("application profile %s: %w", name, ErrNotFound)
+}
+
+func (edge *edgeLoadBalancer) CreatePool(pool *types.LbPool) (*types.LbPool, error) {
+	id, err := edge.doWithLocation(http.MethodPost, types.LbServerPoolPath, "error creating load balancer server pool", pool, nil)
+	if err != nil {
+		return nil, err
+	}
+	pool.ID = id
+	edge.Pools = append(edge.Pools, pool)
+	return pool, nil
+}
+
+func (edge *edgeLoadBalancer) UpdatePool(pool *types.LbPool) (*types.LbPool, error) {
+	err := edge.do(http.MethodPut, types.LbServerPoolPath+pool.ID, "error while updating load balancer server pool", pool, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+func (edge *edgeLoadBalancer) DeletePool(id string) error {
+	err := edge.do(http.MethodDelete, types.LbServerPoolPath+id, "unable to delete server pool", nil, nil)
+	if err != nil {
+		return err
+	}
+	//NOTE: A new slice is built so callers can keep ranging over the previous one
+	pools := make([]*types.LbPool, 0, len(edge.Pools))
+	for _, pool := range edge.Pools {
+		if pool.ID != id {
+			pools = append(pools, pool)
+		}
+	}
+	edge.Pools = pools
+	return nil
+}
+
+func (edge *edgeLoadBalancer) CreateVirtualServer(vServer *types.LbVirtualServer) (*types.LbVirtualServer, error) {
+	id, err := edge.doWithLocation(http.MethodPost, types.LbVirtualServerPath, "error creating load balancer virtual server", vServer, nil)
+	if err != nil {
+		return nil, err
+	}
+	vServer.ID = id
+	edge.VirtualServers = append(edge.VirtualServers, vServer)
+	return vServer, nil
+}
+
+func (edge *edgeLoadBalancer) UpdateVirtualServer(vServer *types.LbVirtualServer) (*types.LbVirtualServer, error) {
+	err := edge.do(http.MethodPut, types.LbVirtualServerPath+vServer.ID, "error while updating load balancer virtual server", vServer, nil)
+	if err != nil {
+		return nil, err
+	}
+	return vServer, nil
+}
+
+func (edge *edgeLoadBalancer) DeleteVirtualServer(id string) error {
+	err := edge.do(http.MethodDelete, types.LbVirtualServerPath+id, "unable to delete virtual server", nil, nil)
+	if err != nil {
+		return err
+	}
+	vServers := make([]*types.LbVirtualServer, 0, len(edge.VirtualServers))
+	for _, vServer := range edge.VirtualServers {
+		if vServer.ID != id {
+			vServers = append(vServers, vServer)
+		}
+	}
+	edge.VirtualServers = vServers
+	return nil
+}
+
+// FirewallRules reads the firewall rules of the edge on first use
+func (edge *edgeLoadBalancer) FirewallRules() ([]*types.EdgeFirewallRule, error) {
+	if edge.firewallRulesRead {
+		return edge.firewallRules, nil
+	}
+	var rules []*types.EdgeFirewallRule
+	err := retryOnTransientError(edge.ctx, "edge_list_firewall_rules", func() error {
+		return edge.withSession(func() error {
+			edge.requests++
+			gateway := edge.objects.newEdgeGateway()
+			return callWithContext(edge.ctx, func() error {
+				var err error
+				rules, err = gateway.GetAllNsxvFirewallRules()
+				return err
+			})
+		})
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return nil, err
+	}
+	edge.firewallRules = rules
+	edge.firewallRulesRead = true
+	return rules, nil
+}
+
+func (edge *edgeLoadBalancer) FirewallRuleByName(name string) (*types.EdgeFirewallRule, error) {
+	rules, err := edge.FirewallRulesByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, ErrNotFound
+	}
+	return rules[0], nil
+}
+
+// FirewallRulesByName returns all rules of the given name in the order of the edge, names are not unique in NSX
+func (edge *edgeLoadBalancer) FirewallRulesByName(name string) ([]*types.EdgeFirewallRule, error) {
+	rules, err := edge.FirewallRules()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*types.EdgeFirewallRule
+	for _, rule := range rules {
+		if rule.Name == name {
+			matches = append(matches, rule)
+		}
+	}
+	return matches, nil
+}
+
+func (edge *edgeLoadBalancer) CreateFirewallRule(rule *types.EdgeFirewallRule, aboveRuleId string) (*types.EdgeFirewallRule, error) {
+	unlock, err := edge.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	var created *types.EdgeFirewallRule
+	err = retryOnRejection(edge.ctx, "edge_create_firewall_rule", func() error {
+		return edge.withSession(func() error {
+			//NOTE: govcd reads the rule back after creating it
+			edge.requests += 2
+			return callUntilDone(edge.ctx, func() error {
+				var err error
+				created, err = edge.objects.newEdgeGateway().CreateNsxvFirewallRule(rule, aboveRuleId)
+				return err
+			})
+		})
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return nil, err
+	}
+	edge.firewallRules = append(edge.firewallRules, created)
+	return created, nil
+}
+
+func (edge *edgeLoadBalancer) UpdateFirewallRule(rule *types.EdgeFirewallRule) (*types.EdgeFirewallRule, error) {
+	unlock, err := edge.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	var updated *types.EdgeFirewallRule
+	err = retryOnTransientError(edge.ctx, "edge_update_firewall_rule", func() error {
+		return edge.withSession(func() error {
+			//NOTE: govcd reads the rule back after updating it
+			edge.requests += 2
+			return callUntilDone(edge.ctx, func() error {
+				var err error
+				updated, err = edge.objects.newEdgeGateway().UpdateNsxvFirewallRule(rule)
+				return err
+			})
+		})
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return nil, err
+	}
+	for i, existing := range edge.firewallRules {
+		if existing.ID == updated.ID {
+			edge.firewallRules[i] = updated
+		}
+	}
+	return updated, nil
+}
+
+func (edge *edgeLoadBalancer) DeleteFirewallRule(id string) error {
+	unlock, err := edge.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = retryOnTransientError(edge.ctx, "edge_delete_firewall_rule", func() error {
+		return edge.withSession(func() error {
+			//NOTE: govcd checks the rule exists before deleting it
+			edge.requests += 2
+			return callUntilDone(edge.ctx, func() error {
+				return edge.objects.newEdgeGateway().DeleteNsxvFirewallRuleById(id)
+			})
+		})
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return err
+	}
+	rules := make([]*types.EdgeFirewallRule, 0, len(edge.firewallRules))
+	for _, rule := range edge.firewallRules {
+		if rule.ID != id {
+			rules = append(rules, rule)
+		}
+	}
+	edge.firewallRules = rules
+	return nil
+}
+
+// NatRules reads the NAT rules of the edge on first use
+func (edge *edgeLoadBalancer) NatRules() ([]*types.EdgeNatRule, error) {
+	if edge.natRulesRead {
+		return edge.natRules, nil
+	}
+	var config edgeNatConfig
+	err := edge.do(http.MethodGet, types.EdgeNatPath, "unable to read NAT configuration", nil, &config)
+	if err != nil {
+		return nil, err
+	}
+	edge.natRules = config.Rules
+	edge.natRulesRead = true
+	return config.Rules, nil
+}
+
+func (edge *edgeLoadBalancer) CreateNatRule(rule *types.EdgeNatRule) (*types.EdgeNatRule, error) {
+	rules, err := edge.NatRules()
+	if err != nil {
+		return nil, err
+	}
+	// Location header should look similar to: /network/edges/edge-3/nat/config/rules/197157
+	id, err := edge.doWithLocation(http.MethodPost, types.EdgeCreateNatPath, "error creating NAT rule", &edgeNatRules{Rules: []*types.EdgeNatRule{rule}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	rule.ID = id
+	edge.natRules = append(rules, rule)
+	return rule, nil
+}
+
+func (edge *edgeLoadBalancer) UpdateNatRule(rule *types.EdgeNatRule) (*types.EdgeNatRule, error) {
+	err := edge.do(http.MethodPut, types.EdgeCreateNatPath+"/"+rule.ID, "error while updating NAT rule", rule, nil)
+	if err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (edge *edgeLoadBalancer) DeleteNatRule(id string) error {
+	err := edge.do(http.MethodDelete, types.EdgeCreateNatPath+"/"+id, "unable to delete NAT rule", nil, nil)
+	if err != nil {
+		return err
+	}
+	rules := make([]*types.EdgeNatRule, 0, len(edge.natRules))
+	for _, rule := range edge.natRules {
+		if rule.ID != id {
+			rules = append(rules, rule)
+		}
+	}
+	edge.natRules = rules
+	return nil
+}
+
+// recordManagedObjects updates the managed_objects metric from the objects of the cluster on the edge.
+// Firewall and NAT rules are only counted if the operation read them anyway.
+func (edge *edgeLoadBalancer) recordManagedObjects(clusterName string) {
+	var vservers, pools int
+	for _, vserver := range edge.VirtualServers {
+		if checkOwnership(clusterName, vserver.Name, vserver.Description) == nil {
+			vservers++
+		}
+	}
+	for _, pool := range edge.Pools {
+		if checkOwnership(clusterName, pool.Name, pool.Description) == nil {
+			pools++
+		}
+	}
+	managedObjects.WithLabelValues("virtual_server").Set(float64(vservers))
+	managedObjects.WithLabelValues("pool").Set(float64(pools))
+
+	if edge.firewallRulesRead {
+		prefix := buildObjectName("", virtualServerNamePrefix, clusterName) + "_"
+		var rules int
+		for _, rule := range edge.firewallRules {
+			if strings.HasPrefix(rule.Name, prefix) {
+				rules++
+			}
+		}
+		managedObjects.WithLabelValues("firewall_rule").Set(float64(rules))
+	}
+	if edge.natRulesRead {
+		var rules int
+		for _, rule := range edge.natRules {
+			if checkOwnership(clusterName, rule.ID, rule.Description) == nil {
+				rules++
+			}
+		}
+		managedObjects.WithLabelValues("nat_rule").Set(float64(rules))
+	}
+}
+
+// logRequests reports how many requests an operation needed
+func (edge *edgeLoadBalancer) logRequests(operation string, serviceName string) {
+	klog.V(4).Infof("%s: %s finished after %d vCloud API requests", operation, serviceName, edge.requests)
+}
@@ -0,0 +1,125 @@
+package vcloud
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// envPrefix is the prefix of all environment variables that override the cloud-config
+const envPrefix = "VCLOUD_"
+
+var durationType = reflect.TypeOf(Duration{})
+
+// envVariable is a cloud-config field that can be set from the environment
+type envVariable struct {
+	Name  string
+	Field string
+	value reflect.Value
+}
+
+// envName turns a yaml key into the upper snake case used for environment variables, e.g. edgeGateway becomes EDGE_GATEWAY
+func envName(key string) string {
+	runes := []rune(key)
+	var name strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				name.WriteRune('_')
+			}
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// envVariables lists the environment variables of all fields of cfg. The name is derived from the yaml key
+// of the field and its parents, e.g. garbageCollector.dryRun is VCLOUD_GARBAGE_COLLECTOR_DRY_RUN.
+// An env tag on the field replaces the derived name.
+func envVariables(cfg *Config) []envVariable {
+	return collectEnvVariables(reflect.ValueOf(cfg).Elem(), envPrefix, "")
+}
+
+func collectEnvVariables(v reflect.Value, prefix string, path string) []envVariable {
+	var variables []envVariable
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("yaml")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + envName(key)
+		fieldPath := key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			variables = append(variables, collectEnvVariables(v.Field(i), name+"_", fieldPath)...)
+			continue
+		}
+		if env := field.Tag.Get("env"); env != "" {
+			name = env
+		}
+		variables = append(variables, envVariable{Name: name, Field: fieldPath, value: v.Field(i)})
+	}
+	return variables
+}
+
+// set parses value into the field of the variable
+func (e envVariable) set(value string) error {
+	switch {
+	case e.value.Type() == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		e.value.Set(reflect.ValueOf(Duration{duration}))
+	case e.value.Kind() == reflect.String:
+		e.value.SetString(value)
+	case e.value.Kind() == reflect.Slice && e.value.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		e.value.Set(reflect.ValueOf(items))
+	case e.value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		e.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", e.value.Type())
+	}
+	return nil
+}
+
+// applyEnvOverrides sets every field whose environment variable is set, environment variables take precedence over the file
+func applyEnvOverrides(cfg *Config, lookup func(string) (string, bool)) error {
+	var errs []error
+	for _, variable := range envVariables(cfg) {
+		value, ok := lookup(variable.Name)
+		if !ok {
+			continue
+		}
+		if err := variable.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value of %s for %s: %s", variable.Name, variable.Field, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// applyProcessEnvOverrides applies the environment of the process
+func applyProcessEnvOverrides(cfg *Config) error {
+	return applyEnvOverrides(cfg, os.LookupEnv)
+}
@@ -0,0 +1,39 @@
+package vcloud
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// EventReasonNameCollision is used when an object on the edge has the name we need but belongs to someone else
+	EventReasonNameCollision = "LoadBalancerNameCollision"
+	// EventReasonIPAllocated is used when a free IP of network.ipNet was picked for the vServers of a Service
+	EventReasonIPAllocated = "LoadBalancerIPAllocated"
+	// EventReasonPoolCreated is used when a pool was created for a ServicePort
+	EventReasonPoolCreated = "LoadBalancerPoolCreated"
+	// EventReasonVirtualServerCreated is used when a vServer was created for a ServicePort
+	EventReasonVirtualServerCreated = "LoadBalancerVirtualServerCreated"
+	// EventReasonNatRuleCreated is used when a DNAT rule was created for a ServicePort
+	EventReasonNatRuleCreated = "LoadBalancerNatRuleCreated"
+	// EventReasonFirewallRuleCreated is used when a firewall rule was created for a Service
+	EventReasonFirewallRuleCreated = "LoadBalancerFirewallRuleCreated"
+
+	// The failure reasons name the step that failed, the message carries the vCloud error. Failures of a whole
+	// reconcile are already reported by the service controller as SyncLoadBalancerFailed.
+	EventReasonIPAllocationFailed  = "LoadBalancerIPAllocationFailed"
+	EventReasonPoolFailed          = "LoadBalancerPoolFailed"
+	EventReasonVirtualServerFailed = "LoadBalancerVirtualServerFailed"
+	EventReasonNatRuleFailed       = "LoadBalancerNatRuleFailed"
+	EventReasonFirewallRuleFailed  = "LoadBalancerFirewallRuleFailed"
+)
+
+// recordEvent emits an Event on the Service, it is a no-op until Initialize set up the recorder
+func (loadBalancer *LB) recordEvent(service *corev1.Service, eventType string, reason string, messageFmt string, args ...interface{}) {
+	recorder := loadBalancer.vCloud.eventRecorder
+	if recorder == nil {
+		klog.V(4).Infof("No event recorder configured, dropping %s event %s for service %s/%s", eventType, reason, service.Namespace, service.Name)
+		return
+	}
+	recorder.Eventf(service, eventType, reason, messageFmt, args...)
+}
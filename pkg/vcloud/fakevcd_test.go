@@ -0,0 +1,618 @@
+package vcloud
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	fakeOrgID     = "11111111-1111-1111-1111-111111111111"
+	fakeVDCID     = "22222222-2222-2222-2222-222222222222"
+	fakeEdgeID    = "33333333-3333-3333-3333-333333333333"
+	fakeNetworkID = "44444444-4444-4444-4444-444444444444"
+	fakeAPIToken  = "api-token"
+	fakeIPNet     = "10.13.37.0/24"
+)
+
+// fakeFirewallConfig is the answer of GET firewall/config, govcd keeps its own type unexported
+type fakeFirewallConfig struct {
+	XMLName xml.Name                  `xml:"firewall"`
+	Rules   []*types.EdgeFirewallRule `xml:"firewallRules>firewallRule"`
+}
+
+// fakeIPSets is the answer of GET ipset/scope/<vdc>
+type fakeIPSets struct {
+	XMLName xml.Name           `xml:"list"`
+	IPSets  []*types.EdgeIpSet `xml:"ipset"`
+}
+
+// fakeVCD serves the parts of the vCloud and NSX API the load balancer uses, with one org, VDC, network and edge.
+// Logins exchange fakeAPIToken for access tokens that stay valid until revokeSessions is called.
+type fakeVCD struct {
+	*httptest.Server
+	t testing.TB
+
+	lock sync.Mutex
+	// requests lists every request as "METHOD path" in the order it was received
+	requests []string
+	// intercept is called before a request is served, it answers the request itself if it returns true
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+	tokens    map[string]bool
+	logins    int
+	nextID    int
+
+	// writeDelay widens the window in which concurrent writes to the edge would overlap
+	writeDelay time.Duration
+	writing    int
+	// overlappingWrites counts writes to the edge that started while another one was in flight
+	overlappingWrites int
+
+	virtualServers []*types.LbVirtualServer
+	pools          []*types.LbPool
+	appProfiles    []*types.LbAppProfile
+	natRules       []*types.EdgeNatRule
+	firewallRules  []*types.EdgeFirewallRule
+	ipSets         []*types.EdgeIpSet
+	allocated      []string
+}
+
+func newFakeVCD(t testing.TB) *fakeVCD {
+	f := &fakeVCD{
+		t:           t,
+		tokens:      map[string]bool{},
+		appProfiles: []*types.LbAppProfile{{ID: "applicationProfile-1", Name: "ingress", Template: "HTTP"}},
+		firewallRules: []*types.EdgeFirewallRule{
+			{ID: "131074", Name: "default rule for ingress traffic", RuleType: "default_policy", Action: "deny", Enabled: true},
+		},
+		//NOTE: The gateway of the network and an address used by a VM
+		allocated: []string{"10.13.37.1", "10.13.37.2"},
+	}
+	f.Server = httptest.NewTLSServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeVCD) href(path string) string {
+	return f.URL + path
+}
+
+func (f *fakeVCD) edgePath() string {
+	return "/network/edges/" + fakeEdgeID
+}
+
+// Requests returns the requests received so far
+func (f *fakeVCD) Requests() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+// resetRequests forgets the requests received so far
+func (f *fakeVCD) resetRequests() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = nil
+}
+
+// setIntercept replaces the intercept function
+func (f *fakeVCD) setIntercept(intercept func(w http.ResponseWriter, r *http.Request) bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.intercept = intercept
+}
+
+// loginCount returns how often an API token was exchanged for a session
+func (f *fakeVCD) loginCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.logins
+}
+
+// Pools returns the pools on the edge
+func (f *fakeVCD) Pools() []*types.LbPool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*types.LbPool(nil), f.pools...)
+}
+
+// VirtualServers returns the vServers on the edge
+func (f *fakeVCD) VirtualServers() []*types.LbVirtualServer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*types.LbVirtualServer(nil), f.virtualServers...)
+}
+
+// FirewallRules returns the firewall rules of the edge, including the default rule
+func (f *fakeVCD) FirewallRules() []*types.EdgeFirewallRule {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*types.EdgeFirewallRule(nil), f.firewallRules...)
+}
+
+// overlappingWriteCount returns how many writes to the edge overlapped with another one
+func (f *fakeVCD) overlappingWriteCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.overlappingWrites
+}
+
+// revokeSessions invalidates all access tokens, as vCloud does when sessions expire
+func (f *fakeVCD) revokeSessions() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = map[string]bool{}
+}
+
+func (f *fakeVCD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	intercept := f.intercept
+	f.lock.Unlock()
+
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/api/versions":
+		f.writeXML(w, http.StatusOK, &govcd.SupportedVersions{
+			VersionInfos: govcd.VersionInfos{{Version: "31.0", LoginUrl: f.href("/api/sessions")}},
+		})
+		return
+	case strings.HasPrefix(r.URL.Path, "/oauth/tenant/"):
+		f.serveToken(w, r)
+		return
+	}
+
+	if !f.authorized(r) {
+		writeVCDError(w, http.StatusUnauthorized, "This operation is denied.")
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeVCDError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, f.edgePath()+"/") || strings.HasPrefix(r.URL.Path, "/network/services/") {
+		f.serveNSX(w, r, body)
+		return
+	}
+	f.serveVCD(w, r)
+}
+
+func (f *fakeVCD) serveToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("refresh_token") != fakeAPIToken {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.lock.Lock()
+	f.logins++
+	token := fmt.Sprintf("access-token-%d", f.logins)
+	f.tokens[token] = true
+	f.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(oauthToken{AccessToken: token, TokenType: "Bearer", ExpiresIn: 3600})
+}
+
+func (f *fakeVCD) authorized(r *http.Request) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.tokens[strings.TrimPrefix(r.Header.Get(bearerAuthHeader), "Bearer ")]
+}
+
+func (f *fakeVCD) serveVCD(w http.ResponseWriter, r *http.Request) {
+	networkPath := "/api/network/" + fakeNetworkID
+	switch {
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/sessions":
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method != http.MethodGet:
+		writeVCDError(w, http.StatusMethodNotAllowed, "not implemented by the fake")
+	case r.URL.Path == "/api/org":
+		f.writeXML(w, http.StatusOK, &types.OrgList{Org: []*types.Org{{Name: "org1", HREF: f.href("/api/org/" + fakeOrgID)}}})
+	case r.URL.Path == "/api/org/"+fakeOrgID:
+		f.writeXML(w, http.StatusOK, &types.Org{
+			Name: "org1",
+			HREF: f.href(r.URL.Path),
+			Link: types.LinkList{{Rel: "down", Type: types.MimeVDC, Name: "vdc1", HREF: f.href("/api/vdc/" + fakeVDCID)}},
+		})
+	case r.URL.Path == "/api/vdc/"+fakeVDCID:
+		f.writeXML(w, http.StatusOK, &types.Vdc{
+			Name:              "vdc1",
+			HREF:              f.href(r.URL.Path),
+			Link:              types.LinkList{{Rel: "edgeGateways", Type: types.MimeQueryRecords, HREF: f.href("/api/admin/vdc/" + fakeVDCID + "/edgeGateways")}},
+			AvailableNetworks: []*types.AvailableNetworks{{Network: []*types.Reference{{Name: "net1", HREF: f.href(networkPath)}}}},
+		})
+	case r.URL.Path == "/api/admin/vdc/"+fakeVDCID+"/edgeGateways":
+		f.writeXML(w, http.StatusOK, &types.QueryResultEdgeGatewayRecordsType{
+			EdgeGatewayRecord: []*types.QueryResultEdgeGatewayRecordType{{Name: "edge1", HREF: f.href("/api/admin/edgeGateway/" + fakeEdgeID)}},
+		})
+	case r.URL.Path == "/api/admin/edgeGateway/"+fakeEdgeID:
+		advanced := true
+		f.writeXML(w, http.StatusOK, &types.EdgeGateway{
+			Name:          "edge1",
+			HREF:          f.href(r.URL.Path),
+			ID:            "urn:vcloud:gateway:" + fakeEdgeID,
+			Configuration: &types.GatewayConfiguration{AdvancedNetworkingEnabled: &advanced},
+		})
+	case r.URL.Path == networkPath:
+		f.writeXML(w, http.StatusOK, &types.OrgVDCNetwork{Name: "net1", HREF: f.href(r.URL.Path)})
+	case r.URL.Path == networkPath+"/allocatedAddresses":
+		f.lock.Lock()
+		allocation := IpAddressAllocation{}
+		for _, address := range f.allocated {
+			allocation.IpAddress = append(allocation.IpAddress, IpAddress{IpAddress: address})
+		}
+		f.lock.Unlock()
+		f.writeXML(w, http.StatusOK, &allocation)
+	default:
+		writeVCDError(w, http.StatusNotFound, "The requested resource was not found.")
+	}
+}
+
+// serveNSX handles the NSX API proxied for the edge and the network services of the VDC
+func (f *fakeVCD) serveNSX(w http.ResponseWriter, r *http.Request, body []byte) {
+	suffix := strings.TrimPrefix(r.URL.Path, f.edgePath())
+	if r.Method == http.MethodGet {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		switch suffix {
+		case types.LbConfigPath:
+			f.writeXML(w, http.StatusOK, &edgeLoadBalancerConfig{VirtualServers: f.virtualServers, Pools: f.pools, AppProfiles: f.appProfiles})
+		case types.EdgeNatPath:
+			f.writeXML(w, http.StatusOK, &edgeNatConfig{Rules: f.natRules})
+		case types.EdgeFirewallPath:
+			f.writeXML(w, http.StatusOK, &fakeFirewallConfig{Rules: f.firewallRules})
+		case "/network/services/ipset/scope/" + fakeVDCID:
+			f.writeXML(w, http.StatusOK, &fakeIPSets{IPSets: f.ipSets})
+		default:
+			writeNSXError(w, http.StatusNotFound, "The requested object could not be found")
+		}
+		return
+	}
+
+	//NOTE: vCloud does not handle concurrent updates of an edge, the fake reports them instead of failing randomly
+	f.lock.Lock()
+	f.writing++
+	if f.writing > 1 {
+		f.overlappingWrites++
+	}
+	f.lock.Unlock()
+	time.Sleep(f.writeDelay)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writing--
+
+	dir, id := suffix[:strings.LastIndex(suffix, "/")+1], suffix[strings.LastIndex(suffix, "/")+1:]
+	var err error
+	switch {
+	case r.Method == http.MethodPost && suffix == types.LbServerPoolPath:
+		pool := &types.LbPool{}
+		if err = xml.Unmarshal(body, pool); err == nil {
+			pool.ID = f.newID("pool-")
+			f.pools = append(f.pools, pool)
+			f.created(w, types.LbServerPoolPath+pool.ID)
+		}
+	case r.Method == http.MethodPost && suffix == types.LbVirtualServerPath:
+		vserver := &types.LbVirtualServer{}
+		if err = xml.Unmarshal(body, vserver); err == nil {
+			vserver.ID = f.newID("virtualServer-")
+			f.virtualServers = append(f.virtualServers, vserver)
+			f.created(w, types.LbVirtualServerPath+vserver.ID)
+		}
+	case r.Method == http.MethodPost && suffix == types.EdgeCreateNatPath:
+		rules := &edgeNatRules{}
+		if err = xml.Unmarshal(body, rules); err == nil {
+			rule := rules.Rules[0]
+			rule.ID = f.newID("")
+			f.natRules = append(f.natRules, rule)
+			f.created(w, types.EdgeCreateNatPath+"/"+rule.ID)
+		}
+	case r.Method == http.MethodPost && suffix == types.EdgeCreateFirewallPath:
+		rule := &types.EdgeFirewallRule{}
+		if above := r.URL.Query().Get("aboveRuleId"); above != "" {
+			err = xml.Unmarshal(body, rule)
+		} else {
+			var rules struct {
+				Rules []*types.EdgeFirewallRule `xml:"firewallRule"`
+			}
+			if err = xml.Unmarshal(body, &rules); err == nil {
+				rule = rules.Rules[0]
+			}
+		}
+		if err == nil {
+			rule.ID = f.newID("")
+			f.insertFirewallRule(rule, r.URL.Query().Get("aboveRuleId"))
+			f.created(w, types.EdgeCreateFirewallPath+"/"+rule.ID)
+		}
+	case r.Method == http.MethodPost && suffix == "/network/services/ipset/"+fakeVDCID:
+		ipSet := &types.EdgeIpSet{}
+		if err = xml.Unmarshal(body, ipSet); err == nil {
+			revision := 0
+			ipSet.ID = fakeVDCID + ":" + f.newID("ipset-")
+			ipSet.Revision = &revision
+			f.ipSets = append(f.ipSets, ipSet)
+			f.created(w, "/network/services/ipset/"+ipSet.ID)
+		}
+	case r.Method == http.MethodPut:
+		err = f.update(w, dir, id, body)
+	case r.Method == http.MethodDelete:
+		f.delete(w, dir, id)
+	default:
+		writeNSXError(w, http.StatusMethodNotAllowed, "not implemented by the fake")
+	}
+	if err != nil {
+		writeNSXError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+func (f *fakeVCD) newID(prefix string) string {
+	f.nextID++
+	return prefix + strconv.Itoa(f.nextID)
+}
+
+// created answers a POST with the Location header NSX returns
+func (f *fakeVCD) created(w http.ResponseWriter, suffix string) {
+	if strings.HasPrefix(suffix, "/network/") {
+		w.Header().Set("Location", suffix)
+	} else {
+		w.Header().Set("Location", f.edgePath()+suffix)
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// insertFirewallRule places a rule above the given one, or as last user rule in front of the default policy
+func (f *fakeVCD) insertFirewallRule(rule *types.EdgeFirewallRule, above string) {
+	index := len(f.firewallRules)
+	for i, existing := range f.firewallRules {
+		if (above == "" && existing.RuleType == "default_policy") || (above != "" && existing.ID == above) {
+			index = i
+			break
+		}
+	}
+	rule.RuleType = "user"
+	f.firewallRules = append(f.firewallRules[:index], append([]*types.EdgeFirewallRule{rule}, f.firewallRules[index:]...)...)
+}
+
+func (f *fakeVCD) update(w http.ResponseWriter, dir string, id string, body []byte) error {
+	found := false
+	switch dir {
+	case types.LbServerPoolPath:
+		pool := &types.LbPool{}
+		if err := xml.Unmarshal(body, pool); err != nil {
+			return err
+		}
+		for i, existing := range f.pools {
+			if existing.ID == id {
+				pool.ID, f.pools[i], found = id, pool, true
+			}
+		}
+	case types.LbVirtualServerPath:
+		vserver := &types.LbVirtualServer{}
+		if err := xml.Unmarshal(body, vserver); err != nil {
+			return err
+		}
+		for i, existing := range f.virtualServers {
+			if existing.ID == id {
+				vserver.ID, f.virtualServers[i], found = id, vserver, true
+			}
+		}
+	case types.EdgeCreateNatPath + "/":
+		rule := &types.EdgeNatRule{}
+		if err := xml.Unmarshal(body, rule); err != nil {
+			return err
+		}
+		for i, existing := range f.natRules {
+			if existing.ID == id {
+				rule.ID, f.natRules[i], found = id, rule, true
+			}
+		}
+	case types.EdgeCreateFirewallPath + "/":
+		rule := &types.EdgeFirewallRule{}
+		if err := xml.Unmarshal(body, rule); err != nil {
+			return err
+		}
+		for i, existing := range f.firewallRules {
+			if existing.ID == id {
+				rule.ID, rule.RuleType, f.firewallRules[i], found = id, existing.RuleType, rule, true
+			}
+		}
+	case "/network/services/ipset/":
+		ipSet := &types.EdgeIpSet{}
+		if err := xml.Unmarshal(body, ipSet); err != nil {
+			return err
+		}
+		for i, existing := range f.ipSets {
+			if existing.ID == id {
+				if ipSet.Revision == nil || *ipSet.Revision != *existing.Revision {
+					writeNSXError(w, http.StatusBadRequest, "The object "+id+" used in this operation has an older version")
+					return nil
+				}
+				revision := *existing.Revision + 1
+				ipSet.ID, ipSet.Revision, f.ipSets[i], found = id, &revision, ipSet, true
+			}
+		}
+	}
+	if !found {
+		writeNSXError(w, http.StatusNotFound, "The requested object "+id+" could not be found")
+		return nil
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (f *fakeVCD) delete(w http.ResponseWriter, dir string, id string) {
+	found := false
+	switch dir {
+	case types.LbServerPoolPath:
+		for i, pool := range f.pools {
+			if pool.ID == id {
+				for _, vserver := range f.virtualServers {
+					if vserver.DefaultPoolId == id {
+						writeNSXError(w, http.StatusBadRequest, "Pool "+id+" is in use by virtual server "+vserver.ID)
+						return
+					}
+				}
+				f.pools, found = append(f.pools[:i:i], f.pools[i+1:]...), true
+				break
+			}
+		}
+	case types.LbVirtualServerPath:
+		for i, vserver := range f.virtualServers {
+			if vserver.ID == id {
+				f.virtualServers, found = append(f.virtualServers[:i:i], f.virtualServers[i+1:]...), true
+				break
+			}
+		}
+	case types.EdgeCreateNatPath + "/":
+		for i, rule := range f.natRules {
+			if rule.ID == id {
+				f.natRules, found = append(f.natRules[:i:i], f.natRules[i+1:]...), true
+				break
+			}
+		}
+	case types.EdgeCreateFirewallPath + "/":
+		for i, rule := range f.firewallRules {
+			if rule.ID == id {
+				f.firewallRules, found = append(f.firewallRules[:i:i], f.firewallRules[i+1:]...), true
+				break
+			}
+		}
+	case "/network/services/ipset/":
+		for i, ipSet := range f.ipSets {
+			if ipSet.ID == id {
+				f.ipSets, found = append(f.ipSets[:i:i], f.ipSets[i+1:]...), true
+				break
+			}
+		}
+	}
+	if !found {
+		writeNSXError(w, http.StatusNotFound, "The requested object "+id+" could not be found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeVCD) writeXML(w http.ResponseWriter, status int, body interface{}) {
+	data, err := xml.Marshal(body)
+	if err != nil {
+		f.t.Errorf("fake vCloud can not encode %T: %s", body, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", types.AnyXMLMime)
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// writeVCDError answers with the Error document of vCloud
+func writeVCDError(w http.ResponseWriter, status int, message string) {
+	data, _ := xml.Marshal(&types.Error{Message: message, MajorErrorCode: status, MinorErrorCode: strings.ToUpper(strings.Replace(http.StatusText(status), " ", "_", -1))})
+	w.Header().Set("Content-Type", types.AnyXMLMime)
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// writeNSXError answers with the error document of NSX
+func writeNSXError(w http.ResponseWriter, status int, details string) {
+	data, _ := xml.Marshal(&types.NSXError{ErrorCode: strconv.Itoa(status*10 + 1), Details: details, ModuleName: "vShield Edge"})
+	w.Header().Set("Content-Type", types.AnyXMLMime)
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// newFakeLB returns a load balancer that talks to f, modify may change the cloud-config before it is used
+func newFakeLB(t testing.TB, f *fakeVCD, modify func(cfg *Config)) *LB {
+	cachedVCDClients.reset()
+	cachedVCDObjects.invalidate("test")
+
+	cfg := &Config{
+		AuthMethod:  AuthMethodAPIToken,
+		APIToken:    fakeAPIToken,
+		Href:        f.href("/api"),
+		Org:         "org1",
+		VDC:         "vdc1",
+		EdgeGateway: "edge1",
+		Insecure:    true,
+		Network:     NetworkConfig{Name: "net1", IPNet: fakeIPNet},
+	}
+	if modify != nil {
+		modify(cfg)
+	}
+	cloud, err := newVCloud(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloud.loadBalancer
+}
+
+func testService(name string, ports ...int32) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: k8stypes.UID("uid-" + name)},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}
+	for i, port := range ports {
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:     "port-" + strconv.Itoa(int(port)),
+			Protocol: corev1.ProtocolTCP,
+			Port:     port,
+			NodePort: 30000 + int32(i) + port,
+		})
+	}
+	return service
+}
+
+func testNodes(addresses ...string) []*corev1.Node {
+	var nodes []*corev1.Node
+	for i, address := range addresses {
+		nodes = append(nodes, &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "worker-" + strconv.Itoa(i), Labels: map[string]string{IsWorkerNode: "true"}},
+			Status:     corev1.NodeStatus{Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: address}}},
+		})
+	}
+	return nodes
+}
+
+// objectsOf returns the names of the vServers and pools on the fake edge that belong to the Service
+func (f *fakeVCD) objectsOf(clusterName string, service *corev1.Service) (vservers []*types.LbVirtualServer, pools []*types.LbPool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, vserver := range f.virtualServers {
+		if isOwnedBy(clusterName, vserver.Description, service) {
+			vservers = append(vservers, vserver)
+		}
+	}
+	for _, pool := range f.pools {
+		if isOwnedBy(clusterName, pool.Description, service) {
+			pools = append(pools, pool)
+		}
+	}
+	return vservers, pools
+}
+
+// memberAddresses returns the sorted addresses of the members of a pool
+func memberAddresses(pool *types.LbPool) []string {
+	var addresses []string
+	for _, member := range pool.Members {
+		addresses = append(addresses, member.IpAddress)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
@@ -0,0 +1,284 @@
+package vcloud
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	servicehelpers "k8s.io/cloud-provider/service/helpers"
+	"k8s.io/klog"
+)
+
+// firewallSources returns the allowed sources of a Service taken from loadBalancerSourceRanges or the
+// service.beta.kubernetes.io/load-balancer-source-ranges annotation. If the Service sets neither,
+// defaultSources are used and "any" if there are none.
+func firewallSources(service *corev1.Service, defaultSources []string) ([]string, error) {
+	_, hasAnnotation := service.Annotations[corev1.AnnotationLoadBalancerSourceRangesKey]
+	if len(service.Spec.LoadBalancerSourceRanges) == 0 && !hasAnnotation && len(defaultSources) > 0 {
+		sources := append([]string(nil), defaultSources...)
+		sort.Strings(sources)
+		return sources, nil
+	}
+	ipnets, err := servicehelpers.GetLoadBalancerSourceRanges(service)
+	if err != nil {
+		return nil, err
+	}
+	if servicehelpers.IsAllowAll(ipnets) {
+		return []string{"any"}, nil
+	}
+	sources := ipnets.StringSlice()
+	sort.Strings(sources)
+	return sources, nil
+}
+
+// getBoolFromServiceAnnotation returns the boolean value of an annotation or defaultSetting if it is missing or invalid
+func getBoolFromServiceAnnotation(service *corev1.Service, annotationKey string, defaultSetting bool) bool {
+	value, ok := service.Annotations[annotationKey]
+	if !ok {
+		return defaultSetting
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		klog.Warningf("Ignoring invalid %s annotation %q on %s/%s", annotationKey, value, service.Namespace, service.Name)
+		return defaultSetting
+	}
+	return b
+}
+
+// denyByDefault reports whether traffic to the Service from all other sources is dropped explicitly.
+// The annotation takes precedence over firewall.denyByDefault of the cloud-config.
+func (loadBalancer *LB) denyByDefault(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, LoadBalancerFirewallDenyByDefault, loadBalancer.vCloud.cfg.Firewall.DenyByDefault)
+}
+
+// firewallLogging reports whether the rules of the Service log matching traffic.
+// The annotation takes precedence over firewall.logging of the cloud-config.
+func (loadBalancer *LB) firewallLogging(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, LoadBalancerFirewallLogging, loadBalancer.vCloud.cfg.Firewall.Logging)
+}
+
+// internalFirewall reports whether an internal load balancer gets managed firewall rules.
+// The annotation takes precedence over firewall.internal.enabled of the cloud-config.
+func (loadBalancer *LB) internalFirewall(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, LoadBalancerFirewallInternal, loadBalancer.vCloud.cfg.Firewall.Internal.Enabled)
+}
+
+// firewallProtocols maps the protocols of ServicePorts to the protocols of the edge firewall
+var firewallProtocols = map[corev1.Protocol]string{
+	"":                 "TCP",
+	corev1.ProtocolTCP: "TCP",
+	corev1.ProtocolUDP: "UDP",
+}
+
+// firewallApplication returns every port of the Service with its protocol as firewall services
+func firewallApplication(service *corev1.Service) (types.EdgeFirewallApplication, error) {
+	var services []types.EdgeFirewallApplicationService
+	seen := map[string]bool{}
+	for _, port := range service.Spec.Ports {
+		protocol, ok := firewallProtocols[port.Protocol]
+		if !ok {
+			return types.EdgeFirewallApplication{}, fmt.Errorf("protocol %s of port %s is not supported by the edge firewall", port.Protocol, portKey(port))
+		}
+		key := protocol + "/" + strconv.Itoa(int(port.Port))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		services = append(services, types.EdgeFirewallApplicationService{
+			Protocol:   protocol,
+			Port:       strconv.Itoa(int(port.Port)),
+			SourcePort: "any",
+		})
+	}
+	return types.EdgeFirewallApplication{Services: services}, nil
+}
+
+// anchorRuleID returns the ID of the configured anchor rule new rules are placed above,
+// it is empty without an anchor which places new rules at the end of the user rules
+func (loadBalancer *LB) anchorRuleID(edge *edgeLoadBalancer) (string, error) {
+	name := loadBalancer.vCloud.cfg.Firewall.AnchorRule
+	if name == "" {
+		return "", nil
+	}
+	rule, err := edge.FirewallRuleByName(name)
+	if err != nil {
+		return "", fmt.Errorf("error fetching firewall.anchorRule %s: %w", name, err)
+	}
+	return rule.ID, nil
+}
+
+// sameStrings compares two lists regardless of their order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// firewallServiceKeys returns a comparable form of the services of a rule, NSX returns the protocol in lower case
+func firewallServiceKeys(application types.EdgeFirewallApplication) []string {
+	var keys []string
+	for _, service := range application.Services {
+		keys = append(keys, strings.ToLower(service.Protocol)+"/"+service.Port+"/"+service.SourcePort)
+	}
+	return keys
+}
+
+// firewallRuleChanged reports whether rule differs from the desired rule in any field we manage
+func firewallRuleChanged(rule *types.EdgeFirewallRule, desired *types.EdgeFirewallRule) bool {
+	return rule.Name != desired.Name ||
+		!strings.EqualFold(rule.Action, desired.Action) ||
+		rule.Enabled != desired.Enabled ||
+		rule.LoggingEnabled != desired.LoggingEnabled ||
+		!sameStrings(rule.Source.IpAddresses, desired.Source.IpAddresses) ||
+		!sameStrings(rule.Destination.IpAddresses, desired.Destination.IpAddresses) ||
+		!sameStrings(firewallServiceKeys(rule.Application), firewallServiceKeys(desired.Application))
+}
+
+// findFirewallRules returns the rules of the first of names that exists on the edge
+func findFirewallRules(edge *edgeLoadBalancer, names ...string) ([]*types.EdgeFirewallRule, error) {
+	for _, name := range names {
+		rules, err := edge.FirewallRulesByName(name)
+		if err != nil || len(rules) > 0 {
+			return rules, err
+		}
+	}
+	return nil, nil
+}
+
+// ensureFirewallRule creates the desired rule above the rule aboveRuleID or updates the existing rule of the same name.
+// A rule found by legacyName is renamed to the name of the desired rule. Rules of other clusters are never modified.
+func (loadBalancer *LB) ensureFirewallRule(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, desired *types.EdgeFirewallRule, legacyName string, aboveRuleID string) error {
+	rules, err := findFirewallRules(edge, desired.Name, legacyName)
+	if err != nil {
+		return fmt.Errorf("error fetching NSXV Firewall Rule: %s", err.Error())
+	}
+	if len(rules) == 0 {
+		klog.V(4).Infof("Creating NSXV Rule %s", desired.Name)
+		if _, err := edge.CreateFirewallRule(desired, aboveRuleID); err != nil {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonFirewallRuleFailed, "Creating firewall rule %s failed: %s", desired.Name, err.Error())
+			return fmt.Errorf("error creating NSXV Firewall Rule: %s", err.Error())
+		}
+		loadBalancer.recordEvent(service, corev1.EventTypeNormal, EventReasonFirewallRuleCreated, "Created firewall rule %s (%s) for %s", desired.Name, desired.Action, strings.Join(desired.Source.IpAddresses, ","))
+		return nil
+	}
+	rule := rules[0]
+	if err := checkFirewallRuleOwnership(clusterName, rule, edge.VirtualServers); err != nil {
+		loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to modify firewall rule: %s", err.Error())
+		return err
+	}
+	//NOTE: Duplicates are left over from older releases that repeated creates after a lost answer
+	for _, duplicate := range rules[1:] {
+		if checkFirewallRuleOwnership(clusterName, duplicate, edge.VirtualServers) != nil {
+			continue
+		}
+		klog.V(4).Infof("Deleting duplicate NSXV Rule %s (%s)", duplicate.Name, duplicate.ID)
+		if err := edge.DeleteFirewallRule(duplicate.ID); err != nil {
+			return fmt.Errorf("error deleting duplicate NSXV Firewall Rule: %s", err.Error())
+		}
+	}
+	if !firewallRuleChanged(rule, desired) {
+		return nil
+	}
+	klog.V(4).Infof("Updating NSXV Rule %s", desired.Name)
+	desired.ID = rule.ID
+	if _, err := edge.UpdateFirewallRule(desired); err != nil {
+		loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonFirewallRuleFailed, "Updating firewall rule %s failed: %s", desired.Name, err.Error())
+		return fmt.Errorf("error updating NSXV Firewall Rule: %s", err.Error())
+	}
+	return nil
+}
+
+// ensureFirewallRules allows the source ranges of the Service, or defaultSources if it has none, to reach destination
+// on all ports of the Service. In deny-by-default mode a second rule right below drops the traffic of all other sources.
+// New rules are placed above the anchor rule, existing rules keep their position.
+func (loadBalancer *LB) ensureFirewallRules(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, destination string, defaultSources []string) error {
+	sources, err := firewallSources(service, defaultSources)
+	if err != nil {
+		return err
+	}
+	application, err := firewallApplication(service)
+	if err != nil {
+		return err
+	}
+	anchorRuleID, err := loadBalancer.anchorRuleID(edge)
+	if err != nil {
+		return err
+	}
+
+	//NOTE: A deny rule left over from an interrupted reconcile must stay below the allow rule
+	aboveRuleID := anchorRuleID
+	denyRules, err := findFirewallRules(edge, firewallDenyRuleName(clusterName, service), legacyFirewallDenyRuleName(clusterName, service))
+	if err != nil {
+		return fmt.Errorf("error fetching NSXV Firewall Rule: %s", err.Error())
+	}
+	if len(denyRules) > 0 {
+		aboveRuleID = denyRules[0].ID
+	}
+
+	allow := newFirewallRule(&FirewallConfig{
+		name:           firewallRuleName(clusterName, service),
+		Source:         types.EdgeFirewallEndpoint{IpAddresses: sources},
+		Destination:    types.EdgeFirewallEndpoint{IpAddresses: []string{destination}},
+		Application:    application,
+		LoggingEnabled: loadBalancer.firewallLogging(service),
+	})
+	if err := loadBalancer.ensureFirewallRule(clusterName, edge, service, allow, legacyFirewallRuleName(clusterName, service), aboveRuleID); err != nil {
+		return err
+	}
+
+	if !loadBalancer.denyByDefault(service) {
+		return loadBalancer.deleteFirewallRules(clusterName, edge, service, firewallDenyRuleName(clusterName, service), legacyFirewallDenyRuleName(clusterName, service))
+	}
+	deny := newFirewallRule(&FirewallConfig{
+		name:           firewallDenyRuleName(clusterName, service),
+		Source:         types.EdgeFirewallEndpoint{IpAddresses: []string{"any"}},
+		Destination:    types.EdgeFirewallEndpoint{IpAddresses: []string{destination}},
+		Application:    application,
+		Action:         "Deny",
+		LoggingEnabled: loadBalancer.firewallLogging(service),
+	})
+	return loadBalancer.ensureFirewallRule(clusterName, edge, service, deny, legacyFirewallDenyRuleName(clusterName, service), anchorRuleID)
+}
+
+// deleteFirewallRules deletes the rules of the given names unless they belong to another cluster
+func (loadBalancer *LB) deleteFirewallRules(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, names ...string) error {
+	for _, name := range names {
+		rules, err := edge.FirewallRulesByName(name)
+		if err != nil {
+			return fmt.Errorf("error retrieving nsxv firewall rule err:%s", err.Error())
+		}
+		for _, rule := range rules {
+			if err := checkFirewallRuleOwnership(clusterName, rule, edge.VirtualServers); err != nil {
+				loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Not deleting firewall rule: %s", err.Error())
+				continue
+			}
+			if err := edge.DeleteFirewallRule(rule.ID); err != nil {
+				return fmt.Errorf("error deleting nsxv firewall rule err:%s", err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// firewallRuleNames returns the names of the allow and the deny rule of the Service, including their legacy names
+func firewallRuleNames(clusterName string, service *corev1.Service) []string {
+	return []string{
+		firewallRuleName(clusterName, service),
+		firewallDenyRuleName(clusterName, service),
+		legacyFirewallRuleName(clusterName, service),
+		legacyFirewallDenyRuleName(clusterName, service),
+	}
+}
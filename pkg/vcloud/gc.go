@@ -0,0 +1,276 @@
+package vcloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+const (
+	defaultGarbageCollectionInterval = 10 * time.Minute
+)
+
+// garbageCollector removes vServers, pools and firewall rules of this cluster whose Service no longer exists.
+// This happens when the controller crashes in the middle of a reconcile or a Service is deleted while it is down.
+type garbageCollector struct {
+	loadBalancer *LB
+	kubeClient   kubernetes.Interface
+	// clusterName is the clusterName of the cloud-config, it may be empty
+	clusterName string
+	dryRun      bool
+}
+
+func newGarbageCollector(loadBalancer *LB, kubeClient kubernetes.Interface, clusterName string, dryRun bool) *garbageCollector {
+	return &garbageCollector{
+		loadBalancer: loadBalancer,
+		kubeClient:   kubeClient,
+		clusterName:  clusterName,
+		dryRun:       dryRun,
+	}
+}
+
+// Run collects orphaned objects every interval until stop is closed.
+// A collection in progress gives up waiting for locks once stop is closed.
+func (gc *garbageCollector) Run(interval time.Duration, stop <-chan struct{}) {
+	klog.V(1).Infof("Starting load balancer garbage collector with interval %s (dry-run: %t)", interval, gc.dryRun)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		start := time.Now()
+		err := gc.collect(ctx)
+		observeReconcile("garbage_collection", start, err)
+		if err != nil {
+			klog.Errorf("garbage collection of load balancer objects failed: %s", err)
+		}
+	}, interval)
+}
+
+// serviceIndex holds everything that identifies the edge objects of the existing LoadBalancer Services
+type serviceIndex struct {
+	uids  sets.String
+	names sets.String
+}
+
+func newServiceIndex(clusterName string, services []corev1.Service) *serviceIndex {
+	index := &serviceIndex{uids: sets.NewString(), names: sets.NewString()}
+	for i := range services {
+		service := &services[i]
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		index.uids.Insert(string(service.UID))
+		index.names.Insert(firewallRuleNames(clusterName, service)...)
+		for _, port := range service.Spec.Ports {
+			index.names.Insert(
+				virtualServerName(clusterName, service, port),
+				poolName(clusterName, service, port),
+				legacyVirtualServerName(clusterName, service, port.NodePort),
+				legacyPoolName(clusterName, service, port.NodePort),
+			)
+		}
+	}
+	return index
+}
+
+// isOrphan reports whether an object with the given description belongs to this cluster but to none of the
+// existing Services. Only objects tagged with this cluster are considered, names are ambiguous between clusters
+// like "prod" and "prod_eu". Untagged objects of older releases are adopted by their Service and never collected.
+func (index *serviceIndex) isOrphan(clusterName string, description string) bool {
+	if !isManagedDescription(description) {
+		return false
+	}
+	owner, ok := parseOwner(description)
+	if !ok || owner.Cluster != clusterName {
+		return false
+	}
+	return !index.uids.Has(owner.ServiceUID)
+}
+
+// clusterAddresses returns the addresses of the vServers and the public IPs of the NAT rules tagged with this cluster
+func clusterAddresses(clusterName string, vservers []*types.LbVirtualServer, natRules []*types.EdgeNatRule) sets.String {
+	addresses := sets.NewString()
+	for _, vserver := range vservers {
+		if owner, ok := parseOwner(vserver.Description); ok && owner.Cluster == clusterName {
+			addresses.Insert(vserver.IpAddress)
+		}
+	}
+	for _, rule := range natRules {
+		if owner, ok := parseOwner(rule.Description); ok && owner.Cluster == clusterName {
+			addresses.Insert(rule.OriginalAddress)
+		}
+	}
+	return addresses
+}
+
+// resolveClusterName returns the cluster name the load balancer methods are called with. Until the first call
+// it falls back to clusterName of the cloud-config. A configured name that differs from the one of the calls
+// is an error, collecting with the wrong name would miss orphans or touch objects of another cluster.
+func (gc *garbageCollector) resolveClusterName() (string, error) {
+	observed := gc.loadBalancer.observedClusterName()
+	if observed == "" {
+		return gc.clusterName, nil
+	}
+	if gc.clusterName != "" && gc.clusterName != observed {
+		return "", fmt.Errorf("refusing to collect garbage: clusterName %q of the cloud-config differs from --cluster-name %q", gc.clusterName, observed)
+	}
+	return observed, nil
+}
+
+func (gc *garbageCollector) collect(ctx context.Context) error {
+	clusterName, err := gc.resolveClusterName()
+	if err != nil {
+		return err
+	}
+	if clusterName == "" {
+		klog.V(2).Infof("Garbage collector: cluster name is not known yet, skipping run")
+		return nil
+	}
+	klog.V(4).Infof("Collecting orphaned load balancer objects for cluster %s", clusterName)
+	ctx, cancel := gc.loadBalancer.withOperationTimeout(ctx)
+	defer cancel()
+
+	//NOTE: The edge is read before the Services, objects of a Service created in between are never seen as orphans
+	edge, err := gc.loadBalancer.readEdgeLoadBalancer(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching vCloud lb configuration: %s", err)
+	}
+	defer edge.logRequests("GarbageCollection", clusterName)
+	defer edge.recordManagedObjects(clusterName)
+	vservers, pools := edge.VirtualServers, edge.Pools
+	rules, err := edge.FirewallRules()
+	if err != nil {
+		return fmt.Errorf("error fetching nsxv firewall rules: %s", err)
+	}
+	natRules, err := edge.NatRules()
+	if err != nil {
+		return fmt.Errorf("error fetching NAT rules: %s", err)
+	}
+
+	services, err := gc.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing services: %s", err)
+	}
+	index := newServiceIndex(clusterName, services.Items)
+
+	usedPools := sets.NewString()
+	for _, vserver := range vservers {
+		if !index.isOrphan(clusterName, vserver.Description) || !gc.isIdle(vserver.Description) {
+			usedPools.Insert(vserver.DefaultPoolId)
+			continue
+		}
+		if gc.report("virtual server", vserver.Name) {
+			continue
+		}
+		if err := edge.DeleteVirtualServer(vserver.ID); err != nil {
+			return fmt.Errorf("error deleting orphaned lb virtual server %s: %s", vserver.Name, err)
+		}
+	}
+
+	for _, pool := range pools {
+		if !index.isOrphan(clusterName, pool.Description) || usedPools.Has(pool.ID) || !gc.isIdle(pool.Description) {
+			continue
+		}
+		if gc.report("pool", pool.Name) {
+			continue
+		}
+		if err := edge.DeletePool(pool.ID); err != nil {
+			return fmt.Errorf("error deleting orphaned lb server pool %s: %s", pool.Name, err)
+		}
+	}
+
+	for _, rule := range natRules {
+		if !index.isOrphan(clusterName, rule.Description) || !gc.isIdle(rule.Description) {
+			continue
+		}
+		if gc.report("NAT rule", rule.ID) {
+			continue
+		}
+		if err := edge.DeleteNatRule(rule.ID); err != nil {
+			return fmt.Errorf("error deleting orphaned NAT rule %s: %s", rule.ID, err)
+		}
+	}
+
+	//NOTE: The addresses are taken from the objects read at the start, before orphans were deleted above
+	addresses := clusterAddresses(clusterName, vservers, natRules)
+	for _, rule := range orphanedFirewallRules(rules, index, clusterName, addresses) {
+		if err := checkFirewallRuleOwnership(clusterName, rule, vservers); err != nil {
+			klog.Warningf("Garbage collector: skipping firewall rule: %s", err)
+			continue
+		}
+		if gc.report("firewall rule", rule.Name) {
+			continue
+		}
+		if err := edge.DeleteFirewallRule(rule.ID); err != nil {
+			return fmt.Errorf("error deleting orphaned nsxv firewall rule %s: %s", rule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// orphanedFirewallRules returns the firewall rules of this cluster that belong to no existing Service.
+// Firewall rules have no description, the name tells the Service and the cluster tag in it the cluster.
+// Rules named before they were tagged are only considered if all their destinations are addresses of this cluster,
+// their name prefix alone also matches clusters like "prod_eu".
+func orphanedFirewallRules(rules []*types.EdgeFirewallRule, index *serviceIndex, clusterName string, addresses sets.String) []*types.EdgeFirewallRule {
+	prefix := firewallRulePrefix(clusterName)
+	legacyPrefix := buildObjectName("", virtualServerNamePrefix, clusterName) + "_"
+	var orphans []*types.EdgeFirewallRule
+	for _, rule := range rules {
+		if index.names.Has(rule.Name) {
+			continue
+		}
+		if strings.HasPrefix(rule.Name, prefix) {
+			orphans = append(orphans, rule)
+			continue
+		}
+		if !strings.HasPrefix(rule.Name, legacyPrefix) {
+			continue
+		}
+		if len(rule.Destination.IpAddresses) == 0 || !addresses.HasAll(rule.Destination.IpAddresses...) {
+			klog.V(4).Infof("Garbage collector: skipping firewall rule %s, its destination is not served by cluster %s", rule.Name, clusterName)
+			continue
+		}
+		orphans = append(orphans, rule)
+	}
+	return orphans
+}
+
+// isIdle reports whether no operation is running for the Service that owns the object.
+// Objects of a Service that is being reconciled right now are left for the next run.
+func (gc *garbageCollector) isIdle(description string) bool {
+	owner, ok := parseOwner(description)
+	if !ok {
+		return true
+	}
+	unlock, ok := gc.loadBalancer.tryLockKey(lockKindService, owner.ServiceUID)
+	if !ok {
+		klog.V(4).Infof("Garbage collector: service %s is busy, skipping its objects", owner.ServiceUID)
+		return false
+	}
+	unlock()
+	return true
+}
+
+// report logs an orphaned object and returns true if it must not be deleted because of dry-run mode
+func (gc *garbageCollector) report(kind string, name string) bool {
+	if gc.dryRun {
+		klog.Infof("Garbage collector (dry-run): would delete orphaned %s %s", kind, name)
+		return true
+	}
+	klog.Infof("Garbage collector: deleting orphaned %s %s", kind, name)
+	return false
+}
@@ -0,0 +1,148 @@
+package vcloud
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// seedObjects adds a vServer, a pool and a NAT rule of owner to the fake edge, as left behind by a crashed reconcile
+func (f *fakeVCD) seedObjects(name string, owner objectOwner, address string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.pools = append(f.pools, &types.LbPool{ID: "pool-" + name, Name: "kube_pool_" + name, Description: owner.describe(PoolDescription)})
+	f.virtualServers = append(f.virtualServers, &types.LbVirtualServer{
+		ID: "virtualServer-" + name, Name: "kube_service_" + name, Description: owner.describe(VirtualServerDescription),
+		IpAddress: address, Port: 80, DefaultPoolId: "pool-" + name,
+	})
+	f.natRules = append(f.natRules, &types.EdgeNatRule{
+		ID: "nat-" + name, Action: "dnat", OriginalAddress: "192.0.2.1", TranslatedAddress: address, Description: owner.describe(NatRuleDescription),
+	})
+}
+
+// seedFirewallRule adds a firewall rule to the fake edge
+func (f *fakeVCD) seedFirewallRule(id string, name string, destination string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.firewallRules = append(f.firewallRules, &types.EdgeFirewallRule{
+		ID: id, Name: name, Action: "accept", Enabled: true,
+		Source:      types.EdgeFirewallEndpoint{IpAddresses: []string{"any"}},
+		Destination: types.EdgeFirewallEndpoint{IpAddresses: []string{destination}},
+	})
+}
+
+// objectIDs returns the sorted IDs of all vServers, pools, NAT and firewall rules on the fake edge
+func (f *fakeVCD) objectIDs() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var ids []string
+	for _, vserver := range f.virtualServers {
+		ids = append(ids, vserver.ID)
+	}
+	for _, pool := range f.pools {
+		ids = append(ids, pool.ID)
+	}
+	for _, rule := range f.natRules {
+		ids = append(ids, rule.ID)
+	}
+	for _, rule := range f.firewallRules {
+		ids = append(ids, rule.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestGarbageCollection(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, func(cfg *Config) {
+		cfg.Firewall.Internal.Enabled = true
+	})
+	ctx := context.Background()
+
+	kept := testService("kept", 80)
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", kept, testNodes("10.13.37.201")); err != nil {
+		t.Fatal(err)
+	}
+	keptIDs := f.objectIDs()
+
+	gone := testService("gone", 80)
+	f.seedObjects("gone", objectOwner{Cluster: "cluster", ServiceUID: string(gone.UID), Port: "port-80"}, "10.13.37.100")
+	f.seedFirewallRule("fw-gone", firewallRuleName("cluster", gone), "10.13.37.100")
+	//NOTE: The controller crashed after deleting the vServer and NAT rule of this Service, but before its firewall rule
+	crashed := testService("crashed", 80)
+	f.seedFirewallRule("fw-crashed", firewallDenyRuleName("cluster", crashed), "10.13.37.101")
+
+	foreign := testService("foreign", 80)
+	f.seedObjects("foreign", objectOwner{Cluster: "cluster_eu", ServiceUID: string(foreign.UID), Port: "port-80"}, "10.13.37.102")
+	f.seedFirewallRule("fw-foreign", firewallRuleName("cluster_eu", foreign), "10.13.37.102")
+	f.seedFirewallRule("fw-foreign-legacy", legacyFirewallRuleName("cluster", foreign), "10.13.37.102")
+	f.seedObjects("legacy", objectOwner{}, "10.13.37.103")
+	f.seedFirewallRule("fw-unmanaged", "allow-ssh", "10.13.37.103")
+	busy := testService("busy", 80)
+	f.seedObjects("busy", objectOwner{Cluster: "cluster", ServiceUID: string(busy.UID), Port: "port-80"}, "10.13.37.104")
+
+	//NOTE: Untagged objects of older releases have no owner marker in their description
+	f.lock.Lock()
+	for _, vserver := range f.virtualServers {
+		if vserver.ID == "virtualServer-legacy" {
+			vserver.Description = VirtualServerDescription
+		}
+	}
+	for _, pool := range f.pools {
+		if pool.ID == "pool-legacy" {
+			pool.Description = PoolDescription
+		}
+	}
+	for _, rule := range f.natRules {
+		if rule.ID == "nat-legacy" {
+			rule.Description = NatRuleDescription
+		}
+	}
+	f.lock.Unlock()
+
+	unlock, err := lb.lockKey(ctx, lockKindService, string(busy.UID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kubeClient := fake.NewSimpleClientset(kept)
+	before := f.objectIDs()
+	if err := newGarbageCollector(lb, kubeClient, "cluster", true).collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if after := f.objectIDs(); !reflect.DeepEqual(after, before) {
+		t.Errorf("expected a dry-run to delete nothing, got %v instead of %v", after, before)
+	}
+
+	if err := newGarbageCollector(lb, kubeClient, "cluster", false).collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(keptIDs,
+		"virtualServer-foreign", "pool-foreign", "nat-foreign", "fw-foreign", "fw-foreign-legacy",
+		"virtualServer-legacy", "pool-legacy", "nat-legacy", "fw-unmanaged",
+		"virtualServer-busy", "pool-busy", "nat-busy",
+	)
+	sort.Strings(expected)
+	if after := f.objectIDs(); !reflect.DeepEqual(after, expected) {
+		t.Errorf("expected\n%v\nto be left, got\n%v", expected, after)
+	}
+
+	//NOTE: Once the Service is idle its objects are collected by the next run
+	unlock()
+	if err := newGarbageCollector(lb, kubeClient, "cluster", false).collect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range f.objectIDs() {
+		if id == "virtualServer-busy" || id == "pool-busy" || id == "nat-busy" {
+			t.Errorf("expected %s to be collected once the Service is idle", id)
+		}
+	}
+
+	if _, exists, err := lb.GetLoadBalancer(ctx, "cluster", kept); err != nil || !exists {
+		t.Errorf("expected the load balancer of the existing Service to be kept, got %t %v", exists, err)
+	}
+}
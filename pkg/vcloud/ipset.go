@@ -0,0 +1,215 @@
+package vcloud
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// ipSetName returns the IP set the addresses of the Service are collected in, it is empty if there is none.
+// The annotation takes precedence over firewall.ipSet of the cloud-config.
+func (loadBalancer *LB) ipSetName(service *corev1.Service) string {
+	if name, ok := service.Annotations[LoadBalancerFirewallIPSet]; ok {
+		return name
+	}
+	return loadBalancer.vCloud.cfg.Firewall.IPSet
+}
+
+// ipSetDescription marks IP sets created for a cluster. IP sets are shared by Services, so they carry no Service.
+func ipSetDescription(clusterName string) string {
+	return fmt.Sprintf("%s (owner: %s=%s)", IPSetDescription, ownerKeyCluster, clusterName)
+}
+
+// isClusterIPSet reports whether the IP set was created by this controller for the given cluster
+func isClusterIPSet(clusterName string, ipSet *types.EdgeIpSet) bool {
+	return ipSet.Description == ipSetDescription(clusterName)
+}
+
+// ipSetAddresses splits the comma separated value of an IP set
+func ipSetAddresses(ipSet *types.EdgeIpSet) sets.String {
+	addresses := sets.NewString()
+	for _, address := range strings.Split(ipSet.IPAddresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses.Insert(address)
+		}
+	}
+	return addresses
+}
+
+// withVDC runs fn with the VDC of the edge, renewing the session once if vCloud rejected it.
+// fn may change IP sets, it is never abandoned while it holds the lock of a set.
+func (edge *edgeLoadBalancer) withVDC(operation string, fn func(vdc *govcd.Vdc) error) error {
+	return retryOnTransientError(edge.ctx, operation, func() error {
+		return edge.withSession(func() error {
+			vdc, err := edge.loadBalancer.vCloud.getVDC(edge.ctx)
+			if err != nil {
+				return err
+			}
+			edge.requests++
+			return callUntilDone(edge.ctx, func() error {
+				return fn(vdc)
+			})
+		})
+	})
+}
+
+// IPSets reads all IP sets of the VDC. VDCs whose IP sets can not be read, e.g. without NSX or without the right
+// to read them, are treated as having none, so Services without an IP set do not fail there.
+func (edge *edgeLoadBalancer) IPSets() ([]*types.EdgeIpSet, error) {
+	var ipSets []*types.EdgeIpSet
+	err := edge.withVDC("vdc_list_ip_sets", func(vdc *govcd.Vdc) error {
+		var err error
+		ipSets, err = vdc.GetAllNsxvIpSets()
+		//NOTE: govcd reports a VDC without IP sets as not found
+		if errors.Is(err, govcd.ErrorEntityNotFound) {
+			return nil
+		}
+		if hasAPIStatus(err, http.StatusForbidden, http.StatusNotFound) {
+			klog.V(4).Infof("IP sets of the VDC can not be read, assuming there are none: %s", err)
+			ipSets = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		invalidateOnStaleObject(err)
+		return nil, fmt.Errorf("error fetching IP sets: %w", err)
+	}
+	return ipSets, nil
+}
+
+// updateIPSet applies change to the addresses of the IP set of the given name. The set is created if it does not exist
+// and change adds addresses, it is deleted once it is empty. IP sets are shared by Services, so every change
+// reads the current addresses under the lock of the set.
+func (edge *edgeLoadBalancer) updateIPSet(clusterName string, name string, change func(addresses sets.String)) error {
+	unlock, err := edge.loadBalancer.lockKey(edge.ctx, lockKindIPSet, name)
+	if err != nil {
+		return fmt.Errorf("error waiting for lock of IP set %s: %s", name, err.Error())
+	}
+	defer unlock()
+
+	return edge.withVDC("vdc_update_ip_set", func(vdc *govcd.Vdc) error {
+		ipSet, err := vdc.GetNsxvIpSetByName(name)
+		if err != nil && !errors.Is(err, govcd.ErrorEntityNotFound) {
+			return err
+		}
+		if ipSet != nil && !isClusterIPSet(clusterName, ipSet) {
+			return fmt.Errorf("%w: IP set %s was not created by the vCloud cloud-controller-manager for cluster %s", ErrForeignObject, name, clusterName)
+		}
+
+		addresses := sets.NewString()
+		if ipSet != nil {
+			addresses = ipSetAddresses(ipSet)
+		}
+		change(addresses)
+
+		switch {
+		case ipSet == nil && addresses.Len() == 0:
+			return nil
+		case ipSet == nil:
+			klog.V(4).Infof("Creating IP set %s", name)
+			_, err = vdc.CreateNsxvIpSet(&types.EdgeIpSet{
+				Name:        name,
+				Description: ipSetDescription(clusterName),
+				IPAddresses: strings.Join(addresses.List(), ","),
+			})
+		case addresses.Len() == 0:
+			klog.V(4).Infof("Deleting empty IP set %s", name)
+			err = vdc.DeleteNsxvIpSetById(ipSet.ID)
+		case !addresses.Equal(ipSetAddresses(ipSet)):
+			klog.V(4).Infof("Updating IP set %s", name)
+			ipSet.IPAddresses = strings.Join(addresses.List(), ",")
+			_, err = vdc.UpdateNsxvIpSet(ipSet)
+		}
+		return err
+	})
+}
+
+// ensureIPSetMembership adds addresses to the IP set of the Service and removes them from all other IP sets
+// of the cluster, e.g. after the annotation was changed or removed. Addresses still used by other Services stay.
+func (loadBalancer *LB) ensureIPSetMembership(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, addresses []string) error {
+	name := loadBalancer.ipSetName(service)
+	ipSets, err := edge.IPSets()
+	if err != nil {
+		return err
+	}
+	inUse, err := addressesOfOtherServices(clusterName, edge, service)
+	if err != nil {
+		return err
+	}
+	remove := sets.NewString(addresses...).Difference(inUse).List()
+	for _, ipSet := range ipSets {
+		if ipSet.Name == name || !isClusterIPSet(clusterName, ipSet) || !ipSetAddresses(ipSet).HasAny(remove...) {
+			continue
+		}
+		if err := edge.updateIPSet(clusterName, ipSet.Name, func(current sets.String) { current.Delete(remove...) }); err != nil {
+			return fmt.Errorf("error removing addresses from IP set %s: %s", ipSet.Name, err.Error())
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	err = edge.updateIPSet(clusterName, name, func(current sets.String) { current.Insert(addresses...) })
+	if errors.Is(err, ErrForeignObject) {
+		loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to modify IP set: %s", err.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("error adding addresses to IP set %s: %s", name, err.Error())
+	}
+	return nil
+}
+
+// addressesOfOtherServices returns the addresses of the vServers and NAT rules of all other Services on the edge,
+// external load balancers of several Services may share an address
+func addressesOfOtherServices(clusterName string, edge *edgeLoadBalancer, service *corev1.Service) (sets.String, error) {
+	natRules, err := edge.NatRules()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching NAT rules: %s", err.Error())
+	}
+	inUse := sets.NewString()
+	for _, vserver := range edge.VirtualServers {
+		if !isOwnedBy(clusterName, vserver.Description, service) {
+			inUse.Insert(vserver.IpAddress)
+		}
+	}
+	for _, rule := range natRules {
+		if !isOwnedBy(clusterName, rule.Description, service) {
+			inUse.Insert(rule.OriginalAddress)
+		}
+	}
+	return inUse, nil
+}
+
+// removeFromIPSets removes addresses from all IP sets of the cluster, whether the Service still names one or not.
+// Addresses still used by other Services are kept.
+func (loadBalancer *LB) removeFromIPSets(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, addresses []string) error {
+	inUse, err := addressesOfOtherServices(clusterName, edge, service)
+	if err != nil {
+		return err
+	}
+	remove := sets.NewString(addresses...).Difference(inUse).List()
+	if len(remove) == 0 {
+		return nil
+	}
+
+	ipSets, err := edge.IPSets()
+	if err != nil {
+		return err
+	}
+	for _, ipSet := range ipSets {
+		if !isClusterIPSet(clusterName, ipSet) || !ipSetAddresses(ipSet).HasAny(remove...) {
+			continue
+		}
+		if err := edge.updateIPSet(clusterName, ipSet.Name, func(current sets.String) { current.Delete(remove...) }); err != nil {
+			return fmt.Errorf("error removing addresses from IP set %s: %s", ipSet.Name, err.Error())
+		}
+	}
+	return nil
+}
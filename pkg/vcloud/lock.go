@@ -1,40 +1,148 @@
 package vcloud
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
 )
 
+// keyLock is a set of mutexes identified by key. Entries are reference counted and removed as soon as
+// nobody holds or waits for them, so the map does not grow with every Service ever seen.
 type keyLock struct {
 	lock sync.Mutex
-	keys map[string]*sync.Mutex
+	keys map[string]*keyLockEntry
+}
+
+// keyLockEntry is a single lock, the channel holds a token while the key is locked
+type keyLockEntry struct {
+	locked chan struct{}
+	refs   int
 }
 
 func newKeyLock() *keyLock {
-	return &keyLock{keys: map[string]*sync.Mutex{}}
+	return &keyLock{keys: map[string]*keyLockEntry{}}
+}
+
+// acquire returns the entry of key and registers the caller as user of it
+func (l *keyLock) acquire(key string) *keyLockEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry := l.keys[key]
+	if entry == nil {
+		entry = &keyLockEntry{locked: make(chan struct{}, 1)}
+		l.keys[key] = entry
+	}
+	entry.refs++
+	return entry
+}
+
+// release unregisters a user of key and removes the entry once it is idle
+func (l *keyLock) release(key string, entry *keyLockEntry) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	entry.refs--
+	if entry.refs == 0 {
+		delete(l.keys, key)
+	}
 }
 
 // Lock locks the key
 func (l *keyLock) Lock(key string) {
-	l.lock.Lock()
-	lock := l.keys[key]
-	if lock == nil {
-		lock = &sync.Mutex{}
-		l.keys[key] = lock
+	entry := l.acquire(key)
+	entry.locked <- struct{}{}
+}
+
+// LockContext locks the key, it gives up and returns the error of the context once ctx is done
+func (l *keyLock) LockContext(ctx context.Context, key string) error {
+	//NOTE: select picks a random ready case, a free key would be taken with a done context half of the time
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	l.lock.Unlock()
+	entry := l.acquire(key)
+	select {
+	case entry.locked <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.release(key, entry)
+		return ctx.Err()
+	}
+}
 
-	lock.Lock()
+// TryLock locks the key if it is not locked and reports whether it did
+func (l *keyLock) TryLock(key string) bool {
+	entry := l.acquire(key)
+	select {
+	case entry.locked <- struct{}{}:
+		return true
+	default:
+		l.release(key, entry)
+		return false
+	}
 }
 
-// Unlock unlocks the key
+// Unlock unlocks the key. Unlocking a key that is not locked is a programming error, it is logged and ignored.
 func (l *keyLock) Unlock(key string) {
 	l.lock.Lock()
-	defer l.lock.Unlock()
+	entry := l.keys[key]
+	l.lock.Unlock()
+
+	if entry == nil {
+		klog.Errorf("unlock of unknown keyLock %s", key)
+		return
+	}
+	select {
+	case <-entry.locked:
+	default:
+		klog.Errorf("unlock of unlocked keyLock %s", key)
+		return
+	}
+	l.release(key, entry)
+}
+
+const (
+	lockKindService = "service"
+	lockKindEdge    = "edge"
+	lockKindIPSet   = "ipset"
+	lockKindNetwork = "network"
+)
+
+// lockKey locks key of the given kind, records how long the caller had to wait and returns the matching unlock function.
+// It fails with the error of the context if ctx is done before the lock could be taken.
+func (loadBalancer *LB) lockKey(ctx context.Context, kind string, key string) (func(), error) {
+	key = kind + "/" + key
+	start := time.Now()
+	err := loadBalancer.keyLock.LockContext(ctx, key)
+	lockWaitDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		loadBalancer.keyLock.Unlock(key)
+	}, nil
+}
+
+// tryLockKey locks key of the given kind if it is free, it returns false if the key is locked
+func (loadBalancer *LB) tryLockKey(kind string, key string) (func(), bool) {
+	key = kind + "/" + key
+	if !loadBalancer.keyLock.TryLock(key) {
+		return nil, false
+	}
+	return func() {
+		loadBalancer.keyLock.Unlock(key)
+	}, true
+}
 
-	lock := l.keys[key]
-	if lock == nil {
-		panic(fmt.Sprintf("unlock of unknown keyLock %s", key))
+// lockService serializes all operations on the load balancer of a Service
+func (loadBalancer *LB) lockService(ctx context.Context, service *corev1.Service) (func(), error) {
+	unlock, err := loadBalancer.lockKey(ctx, lockKindService, serviceKey(service))
+	if err != nil {
+		return nil, fmt.Errorf("error waiting for lock of service %s/%s: %s", service.Namespace, service.Name, err.Error())
 	}
-	lock.Unlock()
+	return unlock, nil
 }
@@ -0,0 +1,126 @@
+package vcloud
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// size returns the number of entries of the keyLock
+func (l *keyLock) size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.keys)
+}
+
+func TestKeyLockContextCancelled(t *testing.T) {
+	l := newKeyLock()
+	l.Lock("a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.LockContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+	l.lock.Lock()
+	refs := l.keys["a"].refs
+	l.lock.Unlock()
+	if refs != 1 {
+		t.Errorf("expected the cancelled waiter to be unregistered, got %d users", refs)
+	}
+
+	l.Unlock("a")
+	if size := l.size(); size != 0 {
+		t.Errorf("expected no entries after the unlock, got %d", size)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.LockContext(cancelled, "b"); err != context.Canceled {
+		t.Errorf("expected a cancelled context to fail, got %v", err)
+	}
+	if size := l.size(); size != 0 {
+		t.Errorf("expected a failed lock to leave no entry, got %d", size)
+	}
+}
+
+func TestKeyLockTryLock(t *testing.T) {
+	l := newKeyLock()
+	l.Lock("a")
+	if l.TryLock("a") {
+		t.Fatalf("expected TryLock to fail while the key is held")
+	}
+	l.Unlock("a")
+	if size := l.size(); size != 0 {
+		t.Errorf("expected no entries after the unlock, got %d", size)
+	}
+
+	if !l.TryLock("a") {
+		t.Fatalf("expected TryLock to succeed on a free key")
+	}
+	l.Unlock("a")
+	if size := l.size(); size != 0 {
+		t.Errorf("expected no entries after the unlock, got %d", size)
+	}
+}
+
+func TestKeyLockHandOver(t *testing.T) {
+	l := newKeyLock()
+	l.Lock("a")
+
+	locked := make(chan struct{})
+	go func() {
+		if err := l.LockContext(context.Background(), "a"); err != nil {
+			t.Errorf("expected the waiter to get the lock, got %s", err)
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("expected the waiter to block while the key is held")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l.Unlock("a")
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the waiter to get the lock after the unlock")
+	}
+	if size := l.size(); size != 1 {
+		t.Errorf("expected the entry to be kept while the waiter holds it, got %d entries", size)
+	}
+	l.Unlock("a")
+	if size := l.size(); size != 0 {
+		t.Errorf("expected no entries after the last unlock, got %d", size)
+	}
+
+	//NOTE: Unlocking a free key is logged and must not corrupt the map
+	l.Unlock("a")
+	if size := l.size(); size != 0 {
+		t.Errorf("expected no entries after unlocking a free key, got %d", size)
+	}
+}
+
+func TestKeyLockIndependentKeys(t *testing.T) {
+	l := newKeyLock()
+	l.Lock("a")
+	defer l.Unlock("a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.LockContext(ctx, "b"); err != nil {
+		t.Fatalf("expected another key not to be blocked, got %s", err)
+	}
+	if !l.TryLock("c") {
+		t.Fatalf("expected TryLock of another key to succeed")
+	}
+	if size := l.size(); size != 3 {
+		t.Errorf("expected an entry per held key, got %d", size)
+	}
+	l.Unlock("b")
+	l.Unlock("c")
+	if size := l.size(); size != 1 {
+		t.Errorf("expected only the entry of the held key to be left, got %d", size)
+	}
+}
@@ -0,0 +1,224 @@
+package vcloud
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsSubsystem = "vcloud"
+
+var (
+	// objectCacheRequests counts lookups of Org, VDC and Edge Gateway by result (hit or miss)
+	objectCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "object_cache_requests_total",
+			Help:           "Number of Org, VDC and Edge Gateway lookups served by the object cache, partitioned by result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	// objectCacheInvalidations counts how often the object cache was dropped and why
+	objectCacheInvalidations = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "object_cache_invalidations_total",
+			Help:           "Number of object cache invalidations, partitioned by reason.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	// lockWaitDuration observes how long operations waited for the per-Service and per-edge locks
+	lockWaitDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "lock_wait_duration_seconds",
+			Help:           "Time spent waiting for the per-Service and per-edge locks, partitioned by lock kind.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 4, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	// retries counts requests repeated because of a transient vCloud error
+	retries = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_retries_total",
+			Help:           "Number of vCloud API requests retried after a transient error, partitioned by operation.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+
+	// retriesExhausted counts operations that still failed with a transient error after the last retry
+	retriesExhausted = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_retries_exhausted_total",
+			Help:           "Number of vCloud API operations that failed after all retries, partitioned by operation.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+
+	// apiRequests counts calls to the vCloud API by operation and result, retried calls are counted per attempt
+	apiRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_requests_total",
+			Help:           "Number of vCloud API calls, partitioned by operation and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "result"},
+	)
+
+	// apiRequestDuration observes the latency of calls to the vCloud API
+	apiRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_request_duration_seconds",
+			Help:           "Latency of vCloud API calls, partitioned by operation.",
+			Buckets:        metrics.ExponentialBuckets(0.05, 2, 10),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+
+	// apiRequestErrors counts failed calls to the vCloud API by operation and error class
+	apiRequestErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "api_request_errors_total",
+			Help:           "Number of failed vCloud API calls, partitioned by operation and error class (HTTP status, timeout, network or other).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "code"},
+	)
+
+	// sessionCacheRequests counts how often a cached vCloud session was reused
+	sessionCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "session_cache_requests_total",
+			Help:           "Number of vCloud session lookups, partitioned by result (hit or miss).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	// logins counts logins into vCloud by the reason the previous session was not reused
+	logins = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "logins_total",
+			Help:           "Number of logins into vCloud, partitioned by reason (initial, session_ttl, token_expired or rejected).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"reason"},
+	)
+
+	// reconcileDuration observes how long the operations on the load balancer of a Service took
+	reconcileDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "reconcile_duration_seconds",
+			Help:           "Duration of load balancer operations of a Service, partitioned by operation and result.",
+			Buckets:        metrics.ExponentialBuckets(0.1, 2, 12),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation", "result"},
+	)
+
+	// managedObjects is the number of edge objects this cluster manages, updated after every operation
+	managedObjects = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "managed_objects",
+			Help:           "Number of edge objects managed for this cluster, partitioned by kind.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"kind"},
+	)
+
+	// freeAddresses is the number of addresses left for internal load balancers, updated on every allocation
+	freeAddresses = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "free_addresses",
+			Help:           "Number of free IP addresses left for internal load balancers, partitioned by network.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"network"},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics registers all metrics of the cloud provider with the registry served by the cloud-controller-manager
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(objectCacheRequests)
+		legacyregistry.MustRegister(objectCacheInvalidations)
+		legacyregistry.MustRegister(lockWaitDuration)
+		legacyregistry.MustRegister(retries)
+		legacyregistry.MustRegister(retriesExhausted)
+		legacyregistry.MustRegister(apiRequests)
+		legacyregistry.MustRegister(apiRequestDuration)
+		legacyregistry.MustRegister(apiRequestErrors)
+		legacyregistry.MustRegister(sessionCacheRequests)
+		legacyregistry.MustRegister(logins)
+		legacyregistry.MustRegister(reconcileDuration)
+		legacyregistry.MustRegister(managedObjects)
+		legacyregistry.MustRegister(freeAddresses)
+	})
+}
+
+// resultLabel returns the result label of an operation
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// errorCode classifies an error of the vCloud API for the code label, so its cardinality stays bounded
+func errorCode(err error) string {
+	//NOTE: govcd only returns the status as part of the message, errors of the restClient use the same format
+	if match := apiErrorStatus.FindStringSubmatch(err.Error()); match != nil {
+		return match[1]
+	}
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// observeAPICall runs a single call to the vCloud API and records its latency and result
+func observeAPICall(operation string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	apiRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	apiRequests.WithLabelValues(operation, resultLabel(err)).Inc()
+	if err != nil {
+		apiRequestErrors.WithLabelValues(operation, errorCode(err)).Inc()
+	}
+	return err
+}
+
+// observeReconcile records the duration of a load balancer operation that started at start
+func observeReconcile(operation string, start time.Time, err error) {
+	reconcileDuration.WithLabelValues(operation, resultLabel(err)).Observe(time.Since(start).Seconds())
+}
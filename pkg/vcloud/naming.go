@@ -0,0 +1,159 @@
+package vcloud
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// maxObjectNameLength is the longest name vCloud accepts for edge load balancer and firewall objects
+	maxObjectNameLength = 255
+	// nameHashLength is the number of hex characters appended to names that had to be shortened
+	nameHashLength = 10
+
+	virtualServerNamePrefix = "kube_service"
+	poolNamePrefix          = "kube_pool"
+	poolMemberNamePrefix    = "member"
+	firewallRuleNamePrefix  = "kube_fw"
+)
+
+var (
+	// validObjectName mirrors the vShield Edge rule for object names:
+	// letters, digits, dash and underscore, starting with a letter (API error: 14571)
+	validObjectName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+	// invalidNameChars matches every character vCloud refuses inside object names
+	invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+)
+
+// ValidateObjectName checks a name against the vCloud naming rules before it is sent to the API
+func ValidateObjectName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("invalid vCloud object name: name must not be empty")
+	}
+	if len(name) > maxObjectNameLength {
+		return fmt.Errorf("invalid vCloud object name %q: longer than %d characters", name, maxObjectNameLength)
+	}
+	if !validObjectName.MatchString(name) {
+		return fmt.Errorf("invalid vCloud object name %q: must contain only letters, digits, dash and underscore and start with a letter", name)
+	}
+	return nil
+}
+
+// sanitizeNamePart replaces every character vCloud does not accept in object names with an underscore
+func sanitizeNamePart(part string) string {
+	return invalidNameChars.ReplaceAllString(part, "_")
+}
+
+// nameHash returns a short deterministic hash for the given key and name
+func nameHash(key string, name string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key+"/"+name)))[:nameHashLength]
+}
+
+// boundedName shortens name to maxObjectNameLength. Names that fit are returned unchanged,
+// longer names are cut and suffixed with a hash of key and the full name so they stay unique.
+func boundedName(key string, name string) string {
+	if len(name) <= maxObjectNameLength {
+		return name
+	}
+	suffix := "-" + nameHash(key, name)
+	return name[:maxObjectNameLength-len(suffix)] + suffix
+}
+
+// buildObjectName joins the sanitized parts with an underscore and bounds the result.
+// key should identify the owning object (e.g. the Service UID) and is only used for the hash suffix.
+func buildObjectName(key string, parts ...string) string {
+	sanitized := make([]string, 0, len(parts))
+	for _, part := range parts {
+		sanitized = append(sanitized, sanitizeNamePart(part))
+	}
+	return boundedName(key, strings.Join(sanitized, "_"))
+}
+
+// serviceKey returns the value used to make names of a Service unique when they need to be shortened
+func serviceKey(service *corev1.Service) string {
+	if service.UID != "" {
+		return string(service.UID)
+	}
+	return service.Namespace + "/" + service.Name
+}
+
+// serviceBaseName returns the name shared by all objects of a Service
+func serviceBaseName(clusterName string, service *corev1.Service) string {
+	return buildObjectName(serviceKey(service), virtualServerNamePrefix, clusterName, service.Namespace, service.Name)
+}
+
+// clusterTag returns a fixed length tag of the cluster name. Cluster names are ambiguous inside object names,
+// e.g. between "prod" and "prod_eu", the tag is not.
+func clusterTag(clusterName string) string {
+	return nameHash("cluster", clusterName)
+}
+
+// firewallRulePrefix returns the prefix of the names of all firewall rules of a cluster. Firewall rules carry no
+// description, the prefix attributes them to the cluster even after its vServers and NAT rules are gone.
+func firewallRulePrefix(clusterName string) string {
+	return firewallRuleNamePrefix + "_" + clusterTag(clusterName) + "_"
+}
+
+// firewallRuleName returns the name of the rule that allows the sources of a Service.
+// The cluster tag comes first so it is kept when the name is shortened.
+func firewallRuleName(clusterName string, service *corev1.Service) string {
+	return buildObjectName(serviceKey(service), firewallRuleNamePrefix, clusterTag(clusterName), clusterName, service.Namespace, service.Name)
+}
+
+// firewallDenyRuleName returns the name of the rule that drops all sources not allowed by the firewall rule of the Service
+func firewallDenyRuleName(clusterName string, service *corev1.Service) string {
+	return boundedName(serviceKey(service), firewallRuleName(clusterName, service)+"-deny")
+}
+
+// legacyFirewallRuleName returns the name of the allow rule before rules were tagged with the cluster
+func legacyFirewallRuleName(clusterName string, service *corev1.Service) string {
+	return serviceBaseName(clusterName, service)
+}
+
+// legacyFirewallDenyRuleName returns the name of the deny rule before rules were tagged with the cluster
+func legacyFirewallDenyRuleName(clusterName string, service *corev1.Service) string {
+	return boundedName(serviceKey(service), serviceBaseName(clusterName, service)+"-deny")
+}
+
+// virtualServerName returns the name of the vServer serving a single ServicePort
+func virtualServerName(clusterName string, service *corev1.Service, port corev1.ServicePort) string {
+	return buildObjectName(serviceKey(service), virtualServerNamePrefix, clusterName, service.Namespace, service.Name, portKey(port))
+}
+
+// poolName returns the name of the pool backing a single ServicePort
+func poolName(clusterName string, service *corev1.Service, port corev1.ServicePort) string {
+	return buildObjectName(serviceKey(service), poolNamePrefix, clusterName, service.Namespace, service.Name, portKey(port))
+}
+
+// legacyVirtualServerName returns the vServer name used before objects were keyed by port name.
+// It is only used to find and adopt objects created by older releases, so it must stay exactly as they built it:
+// unsanitized, cut before the NodePort was appended.
+func legacyVirtualServerName(clusterName string, service *corev1.Service, nodePort int32) string {
+	name := cutString(fmt.Sprintf("%s_%s_%s_%s", virtualServerNamePrefix, clusterName, service.Namespace, service.Name))
+	return fmt.Sprintf("%s-%d", name, nodePort)
+}
+
+// legacyPoolName returns the pool name used before objects were keyed by port name
+func legacyPoolName(clusterName string, service *corev1.Service, nodePort int32) string {
+	return cutString(fmt.Sprintf("%s_%s_%s_%s_%d", poolNamePrefix, clusterName, service.Namespace, service.Name, nodePort))
+}
+
+// cutString truncates names the way older releases did, without a hash suffix
+func cutString(original string) string {
+	if len(original) > maxObjectNameLength {
+		return original[:maxObjectNameLength]
+	}
+	return original
+}
+
+// poolMemberName returns the name of a pool member. Dots and colons are not allowed,
+// so the address is written with dashes which works for IPv4 as well as IPv6.
+func poolMemberName(ip net.IP, port int32) string {
+	address := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return boundedName(ip.String(), fmt.Sprintf("%s-%s-%d", poolMemberNamePrefix, sanitizeNamePart(address), port))
+}
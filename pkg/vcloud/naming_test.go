@@ -0,0 +1,221 @@
+package vcloud
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateObjectName(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{name: "letters, digits, dash and underscore", input: "kube_service_prod-1", valid: true},
+		{name: "single letter", input: "a", valid: true},
+		{name: "maximum length", input: "a" + strings.Repeat("b", maxObjectNameLength-1), valid: true},
+		{name: "empty", input: ""},
+		{name: "too long", input: "a" + strings.Repeat("b", maxObjectNameLength)},
+		{name: "starts with a digit", input: "1service"},
+		{name: "starts with an underscore", input: "_service"},
+		{name: "dot", input: "member-10.0.0.1"},
+		{name: "colon", input: "member-fd00::1"},
+		{name: "space", input: "kube service"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateObjectName(test.input)
+			if test.valid && err != nil {
+				t.Errorf("expected %q to be valid, got %s", test.input, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("expected %q to be invalid", test.input)
+			}
+		})
+	}
+}
+
+func TestSanitizeNamePart(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "web", expected: "web"},
+		{input: "kube-system", expected: "kube-system"},
+		{input: "my.cluster", expected: "my_cluster"},
+		{input: "fd00::1", expected: "fd00__1"},
+		{input: "a b/c", expected: "a_b_c"},
+		{input: "ü", expected: "_"},
+		{input: "", expected: ""},
+	}
+
+	for _, test := range tests {
+		if actual := sanitizeNamePart(test.input); actual != test.expected {
+			t.Errorf("sanitizeNamePart(%q): expected %q, got %q", test.input, test.expected, actual)
+		}
+	}
+}
+
+func TestBoundedName(t *testing.T) {
+	long := "kube_service_" + strings.Repeat("x", maxObjectNameLength)
+	tests := []struct {
+		name      string
+		key       string
+		input     string
+		truncated bool
+	}{
+		{name: "short", key: "uid-1", input: "kube_service_prod_default_web"},
+		{name: "exactly at the limit", key: "uid-1", input: strings.Repeat("a", maxObjectNameLength)},
+		{name: "one over the limit", key: "uid-1", input: strings.Repeat("a", maxObjectNameLength+1), truncated: true},
+		{name: "far over the limit", key: "uid-1", input: long, truncated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual := boundedName(test.key, test.input)
+			if actual != boundedName(test.key, test.input) {
+				t.Errorf("expected the name to be deterministic")
+			}
+			if len(actual) > maxObjectNameLength {
+				t.Errorf("expected at most %d characters, got %d", maxObjectNameLength, len(actual))
+			}
+			if !test.truncated {
+				if actual != test.input {
+					t.Errorf("expected a name within the limit to be unchanged, got %q", actual)
+				}
+				return
+			}
+			suffix := "-" + nameHash(test.key, test.input)
+			if len(actual) != maxObjectNameLength || !strings.HasSuffix(actual, suffix) {
+				t.Errorf("expected a truncated name of %d characters ending in %s, got %q", maxObjectNameLength, suffix, actual)
+			}
+			if !strings.HasPrefix(test.input, strings.TrimSuffix(actual, suffix)) {
+				t.Errorf("expected the truncated name to start with the original name, got %q", actual)
+			}
+		})
+	}
+
+	if boundedName("uid-1", long) == boundedName("uid-2", long) {
+		t.Errorf("expected truncated names of different keys to differ")
+	}
+	if boundedName("uid-1", long+"a") == boundedName("uid-1", long+"b") {
+		t.Errorf("expected truncated names that only differ after the limit to differ")
+	}
+}
+
+func TestObjectNames(t *testing.T) {
+	service := testService("web", 80)
+	port := service.Spec.Ports[0]
+	long := testService(strings.Repeat("web", 100), 80)
+
+	tests := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{name: "vServer", actual: virtualServerName("prod", service, port), expected: "kube_service_prod_default_web_port-80"},
+		{name: "pool", actual: poolName("prod", service, port), expected: "kube_pool_prod_default_web_port-80"},
+		{name: "sanitized cluster name", actual: virtualServerName("prod.example", service, port), expected: "kube_service_prod_example_default_web_port-80"},
+		{name: "unnamed port", actual: poolName("prod", service, corev1.ServicePort{Protocol: corev1.ProtocolUDP, Port: 53}), expected: "kube_pool_prod_default_web_udp-53"},
+		{name: "firewall rule", actual: firewallRuleName("prod", service), expected: "kube_fw_" + clusterTag("prod") + "_prod_default_web"},
+		{name: "deny rule", actual: firewallDenyRuleName("prod", service), expected: "kube_fw_" + clusterTag("prod") + "_prod_default_web-deny"},
+		{name: "legacy firewall rule", actual: legacyFirewallRuleName("prod", service), expected: "kube_service_prod_default_web"},
+		{name: "legacy deny rule", actual: legacyFirewallDenyRuleName("prod", service), expected: "kube_service_prod_default_web-deny"},
+	}
+
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, test.actual)
+		}
+		if err := ValidateObjectName(test.actual); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+
+	for _, name := range []string{
+		virtualServerName("prod", long, port),
+		poolName("prod", long, port),
+		firewallRuleName("prod", long),
+		firewallDenyRuleName("prod", long),
+	} {
+		if err := ValidateObjectName(name); err != nil {
+			t.Errorf("expected names of long Services to be valid: %s", err)
+		}
+	}
+	if virtualServerName("prod", long, port) == virtualServerName("prod", long, corev1.ServicePort{Name: "https", Port: 443}) {
+		t.Errorf("expected truncated vServer names of different ports to differ")
+	}
+}
+
+func TestFirewallRulePrefix(t *testing.T) {
+	service := testService("web", 80)
+	long := testService(strings.Repeat("web", 100), 80)
+
+	for _, name := range []string{
+		firewallRuleName("prod", service),
+		firewallDenyRuleName("prod", service),
+		firewallRuleName("prod", long),
+		firewallDenyRuleName("prod", long),
+	} {
+		if !strings.HasPrefix(name, firewallRulePrefix("prod")) {
+			t.Errorf("expected %q to start with the prefix of the cluster", name)
+		}
+	}
+	//NOTE: "prod_eu" also starts with "prod_", the tags of both clusters must not
+	eu := firewallRuleName("prod_eu", service)
+	if strings.HasPrefix(eu, firewallRulePrefix("prod")) || strings.HasPrefix(firewallRuleName("prod", service), firewallRulePrefix("prod_eu")) {
+		t.Errorf("expected the prefixes of prod and prod_eu to differ, got %q and %q", firewallRuleName("prod", service), eu)
+	}
+}
+
+func TestPoolMemberName(t *testing.T) {
+	tests := []struct {
+		ip       string
+		port     int32
+		expected string
+	}{
+		{ip: "10.13.37.21", port: 30080, expected: "member-10-13-37-21-30080"},
+		{ip: "fd00::1", port: 30080, expected: "member-fd00--1-30080"},
+		{ip: "2001:db8:0:0:0:0:0:42", port: 31000, expected: "member-2001-db8--42-31000"},
+		{ip: "::ffff:10.13.37.21", port: 30080, expected: "member-10-13-37-21-30080"},
+	}
+
+	for _, test := range tests {
+		actual := poolMemberName(net.ParseIP(test.ip), test.port)
+		if actual != test.expected {
+			t.Errorf("poolMemberName(%s, %d): expected %q, got %q", test.ip, test.port, test.expected, actual)
+		}
+		if err := ValidateObjectName(actual); err != nil {
+			t.Errorf("poolMemberName(%s, %d): %s", test.ip, test.port, err)
+		}
+	}
+}
+
+func TestLegacyNames(t *testing.T) {
+	service := testService("web", 80)
+	long := testService(strings.Repeat("web", 100), 80)
+	cut := ("kube_service_prod_default_" + long.Name)[:maxObjectNameLength]
+
+	tests := []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{name: "vServer", actual: legacyVirtualServerName("prod", service, 30080), expected: "kube_service_prod_default_web-30080"},
+		{name: "pool", actual: legacyPoolName("prod", service, 30080), expected: "kube_pool_prod_default_web_30080"},
+		{name: "not sanitized", actual: legacyPoolName("prod.example", service, 30080), expected: "kube_pool_prod.example_default_web_30080"},
+		//NOTE: Older releases cut the vServer name before appending the NodePort
+		{name: "long vServer", actual: legacyVirtualServerName("prod", long, 30080), expected: cut + "-30080"},
+		{name: "long pool", actual: legacyPoolName("prod", long, 30080), expected: ("kube_pool_prod_default_" + long.Name + "_30080")[:maxObjectNameLength]},
+	}
+
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, test.actual)
+		}
+	}
+}
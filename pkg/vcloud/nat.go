@@ -0,0 +1,133 @@
+package vcloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// natPublicIP returns the public IP of a Service of type nat, it is empty for all other types
+func natPublicIP(service *corev1.Service) string {
+	if getStringFromServiceAnnotation(service, LoadBalancerType, "internal") != "nat" {
+		return ""
+	}
+	return getStringFromServiceAnnotation(service, LoadBalancerExternalIP, "")
+}
+
+// natProtocol returns the protocol of a ServicePort as written in NAT rules
+func natProtocol(port corev1.ServicePort) string {
+	if port.Protocol == "" {
+		return "tcp"
+	}
+	return strings.ToLower(string(port.Protocol))
+}
+
+// natRuleFor returns the DNAT rule that forwards a ServicePort from the public IP to the vServer
+func natRuleFor(owner objectOwner, port corev1.ServicePort, publicIP string, vServerIP string) *types.EdgeNatRule {
+	return &types.EdgeNatRule{
+		Action:            "dnat",
+		OriginalAddress:   publicIP,
+		OriginalPort:      strconv.Itoa(int(port.Port)),
+		TranslatedAddress: vServerIP,
+		TranslatedPort:    strconv.Itoa(int(port.Port)),
+		Protocol:          natProtocol(port),
+		Enabled:           true,
+		Description:       owner.describe(NatRuleDescription),
+	}
+}
+
+// natRuleChanged reports whether rule differs from the desired rule in any field we manage
+func natRuleChanged(rule *types.EdgeNatRule, desired *types.EdgeNatRule) bool {
+	return rule.Action != desired.Action ||
+		rule.OriginalAddress != desired.OriginalAddress ||
+		rule.OriginalPort != desired.OriginalPort ||
+		rule.TranslatedAddress != desired.TranslatedAddress ||
+		rule.TranslatedPort != desired.TranslatedPort ||
+		!strings.EqualFold(rule.Protocol, desired.Protocol) ||
+		rule.Enabled != desired.Enabled ||
+		rule.Description != desired.Description
+}
+
+// findConflictingNatRule returns a DNAT rule of someone else that already forwards the same public IP, port and protocol
+func findConflictingNatRule(clusterName string, rules []*types.EdgeNatRule, service *corev1.Service, desired *types.EdgeNatRule) *types.EdgeNatRule {
+	for _, rule := range rules {
+		if rule.Action != "dnat" || isOwnedBy(clusterName, rule.Description, service) {
+			continue
+		}
+		samePort := rule.OriginalPort == desired.OriginalPort || rule.OriginalPort == "" || rule.OriginalPort == "any"
+		sameProtocol := strings.EqualFold(rule.Protocol, desired.Protocol) || rule.Protocol == "" || rule.Protocol == "any"
+		if rule.OriginalAddress == desired.OriginalAddress && samePort && sameProtocol {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ensureNatRules creates or updates a DNAT rule for every ServicePort and deletes all other rules of the Service.
+// Without a public IP every rule of the Service is deleted, e.g. when it is switched from nat to another type.
+func (loadBalancer *LB) ensureNatRules(clusterName string, edge *edgeLoadBalancer, service *corev1.Service, publicIP string, vServerIP string) error {
+	rules, err := edge.NatRules()
+	if err != nil {
+		return fmt.Errorf("error fetching NAT rules: %s", err.Error())
+	}
+
+	desired := map[string]*types.EdgeNatRule{}
+	if publicIP != "" {
+		for _, port := range service.Spec.Ports {
+			owner := ownerFor(clusterName, service, port)
+			desired[owner.Port] = natRuleFor(owner, port, publicIP, vServerIP)
+		}
+	}
+
+	for _, rule := range rules {
+		if !isOwnedBy(clusterName, rule.Description, service) {
+			continue
+		}
+		owner, _ := parseOwner(rule.Description)
+		want, ok := desired[owner.Port]
+		//NOTE: A second rule for the same port is a leftover of an interrupted reconcile
+		if !ok || want.ID != "" {
+			klog.V(4).Infof("Deleting NAT rule %s of %s/%s", rule.ID, service.Namespace, service.Name)
+			if err := edge.DeleteNatRule(rule.ID); err != nil {
+				loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNatRuleFailed, "Deleting NAT rule for %s:%s failed: %s", rule.OriginalAddress, rule.OriginalPort, err.Error())
+				return fmt.Errorf("error deleting NAT rule: %s", err.Error())
+			}
+			continue
+		}
+		want.ID = rule.ID
+		if !natRuleChanged(rule, want) {
+			continue
+		}
+		klog.V(4).Infof("Updating NAT rule %s of %s/%s", rule.ID, service.Namespace, service.Name)
+		want.Vnic = rule.Vnic
+		if _, err := edge.UpdateNatRule(want); err != nil {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNatRuleFailed, "Updating NAT rule for %s:%s failed: %s", want.OriginalAddress, want.OriginalPort, err.Error())
+			return fmt.Errorf("error updating NAT rule: %s", err.Error())
+		}
+		*rule = *want
+	}
+
+	for _, port := range service.Spec.Ports {
+		want, ok := desired[portKey(port)]
+		if !ok || want.ID != "" {
+			continue
+		}
+		if conflict := findConflictingNatRule(clusterName, edge.natRules, service, want); conflict != nil {
+			err := fmt.Errorf("%w: NAT rule %s already forwards %s:%s/%s", ErrForeignObject, conflict.ID, want.OriginalAddress, want.OriginalPort, want.Protocol)
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to create NAT rule: %s", err.Error())
+			return err
+		}
+		klog.V(4).Infof("Creating NAT rule for %s:%s of %s/%s", want.OriginalAddress, want.OriginalPort, service.Namespace, service.Name)
+		if _, err := edge.CreateNatRule(want); err != nil {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNatRuleFailed, "Creating NAT rule for %s:%s failed: %s", want.OriginalAddress, want.OriginalPort, err.Error())
+			return fmt.Errorf("error creating NAT rule: %s", err.Error())
+		}
+		loadBalancer.recordEvent(service, corev1.EventTypeNormal, EventReasonNatRuleCreated, "Created NAT rule forwarding %s:%s to %s", want.OriginalAddress, want.OriginalPort, want.TranslatedAddress)
+	}
+
+	return nil
+}
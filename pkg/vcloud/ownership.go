@@ -0,0 +1,134 @@
+package vcloud
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	ownerKeyCluster    = "cluster"
+	ownerKeyServiceUID = "service-uid"
+	ownerKeyPort       = "port"
+)
+
+var (
+	// ownerMarker matches the ownership metadata we append to descriptions, e.g. "(owner: cluster=prod;port=http;service-uid=1234)"
+	ownerMarker = regexp.MustCompile(`\(owner: ([^)]*)\)`)
+
+	// ErrForeignObject is returned when an object we would modify or delete is owned by another cluster or was not created by us
+	ErrForeignObject = errors.New("object is not owned by this cluster")
+)
+
+// objectOwner identifies the cluster, Service and ServicePort an edge object was created for
+type objectOwner struct {
+	Cluster    string
+	ServiceUID string
+	Port       string
+}
+
+// ownerFor returns the owner of the objects created for the given ServicePort
+func ownerFor(clusterName string, service *corev1.Service, port corev1.ServicePort) objectOwner {
+	return objectOwner{Cluster: clusterName, ServiceUID: string(service.UID), Port: portKey(port)}
+}
+
+// portKey identifies a ServicePort independently of its NodePort. Named ports use their name,
+// unnamed ports (only allowed on single port Services) fall back to protocol and port number.
+func portKey(port corev1.ServicePort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+	return fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), port.Port)
+}
+
+// describe appends the ownership metadata to a description
+func (o objectOwner) describe(description string) string {
+	return fmt.Sprintf("%s (owner: %s=%s;%s=%s;%s=%s)", description,
+		ownerKeyCluster, o.Cluster, ownerKeyPort, o.Port, ownerKeyServiceUID, o.ServiceUID)
+}
+
+// matches reports whether other describes the same object. Objects tagged before the cluster
+// was part of the metadata have no cluster and are matched by Service and port only.
+func (o objectOwner) matches(other objectOwner) bool {
+	return o.ServiceUID == other.ServiceUID && o.Port == other.Port && (other.Cluster == "" || other.Cluster == o.Cluster)
+}
+
+// parseOwner extracts the ownership metadata from a description, it returns false if there is none
+func parseOwner(description string) (objectOwner, bool) {
+	match := ownerMarker.FindStringSubmatch(description)
+	if match == nil {
+		return objectOwner{}, false
+	}
+	var owner objectOwner
+	for _, pair := range strings.Split(match[1], ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case ownerKeyCluster:
+			owner.Cluster = kv[1]
+		case ownerKeyServiceUID:
+			owner.ServiceUID = kv[1]
+		case ownerKeyPort:
+			owner.Port = kv[1]
+		}
+	}
+	return owner, owner.ServiceUID != ""
+}
+
+// isManagedDescription reports whether a description was written by this controller
+func isManagedDescription(description string) bool {
+	return strings.HasPrefix(description, VirtualServerDescription) || strings.HasPrefix(description, PoolDescription) ||
+		strings.HasPrefix(description, NatRuleDescription)
+}
+
+// checkOwnership returns ErrForeignObject unless the object was created by this controller for the given cluster.
+// Objects without a cluster in their metadata were created by older releases and belong to whoever finds them by name.
+func checkOwnership(clusterName string, name string, description string) error {
+	if !isManagedDescription(description) {
+		return fmt.Errorf("%w: %s was not created by the vCloud cloud-controller-manager", ErrForeignObject, name)
+	}
+	if owner, ok := parseOwner(description); ok && owner.Cluster != "" && owner.Cluster != clusterName {
+		return fmt.Errorf("%w: %s belongs to cluster %s", ErrForeignObject, name, owner.Cluster)
+	}
+	return nil
+}
+
+// isOwnedBy reports whether a description carries the ownership metadata of the given Service in this cluster
+func isOwnedBy(clusterName string, description string, service *corev1.Service) bool {
+	owner, ok := parseOwner(description)
+	return ok && service.UID != "" && owner.ServiceUID == string(service.UID) && (owner.Cluster == "" || owner.Cluster == clusterName)
+}
+
+// foreignAddresses returns the IP addresses of all vServers that belong to another cluster
+func foreignAddresses(clusterName string, vservers []*types.LbVirtualServer) sets.String {
+	addresses := sets.NewString()
+	for _, vserver := range vservers {
+		if checkOwnership(clusterName, vserver.Name, vserver.Description) != nil {
+			addresses.Insert(vserver.IpAddress)
+		}
+	}
+	return addresses
+}
+
+// checkFirewallRuleOwnership guards firewall rules, which carry no description. A rule is treated as foreign
+// if it points to an address served by a vServer of another cluster.
+func checkFirewallRuleOwnership(clusterName string, rule *types.EdgeFirewallRule, vservers []*types.LbVirtualServer) error {
+	foreign := foreignAddresses(clusterName, vservers)
+	for _, ip := range rule.Destination.IpAddresses {
+		if foreign.Has(ip) {
+			return fmt.Errorf("%w: firewall rule %s points to %s which is used by another cluster", ErrForeignObject, rule.Name, ip)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package vcloud
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestParseOwner(t *testing.T) {
+	owner := objectOwner{Cluster: "prod", ServiceUID: "1234-5678", Port: "http"}
+
+	tests := []struct {
+		name        string
+		description string
+		expected    objectOwner
+		ok          bool
+	}{
+		{name: "round trip", description: owner.describe(VirtualServerDescription), expected: owner, ok: true},
+		{name: "round trip with empty description", description: owner.describe(""), expected: owner, ok: true},
+		{name: "without cluster of older releases", description: VirtualServerDescription + " (owner: port=http;service-uid=1234-5678)", expected: objectOwner{ServiceUID: "1234-5678", Port: "http"}, ok: true},
+		{name: "text after the marker", description: owner.describe(PoolDescription) + " edited by hand", expected: owner, ok: true},
+		{name: "keys in another order", description: "(owner: service-uid=1234-5678;cluster=prod;port=http)", expected: owner, ok: true},
+		{name: "unknown keys and pairs without value", description: "(owner: zone=a;broken;cluster=prod;port=http;service-uid=1234-5678)", expected: owner, ok: true},
+		{name: "no marker", description: VirtualServerDescription},
+		{name: "empty", description: ""},
+		{name: "unterminated marker", description: "(owner: cluster=prod;service-uid=1234-5678"},
+		{name: "marker without UID", description: "(owner: cluster=prod;port=http)", expected: objectOwner{Cluster: "prod", Port: "http"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, ok := parseOwner(test.description)
+			if ok != test.ok || actual != test.expected {
+				t.Errorf("expected %+v %t, got %+v %t", test.expected, test.ok, actual, ok)
+			}
+		})
+	}
+}
+
+func TestOwnerMatches(t *testing.T) {
+	owner := objectOwner{Cluster: "prod", ServiceUID: "uid-1", Port: "http"}
+
+	tests := []struct {
+		name     string
+		other    objectOwner
+		expected bool
+	}{
+		{name: "same", other: owner, expected: true},
+		{name: "untagged cluster", other: objectOwner{ServiceUID: "uid-1", Port: "http"}, expected: true},
+		{name: "foreign cluster", other: objectOwner{Cluster: "prod_eu", ServiceUID: "uid-1", Port: "http"}},
+		{name: "foreign UID", other: objectOwner{Cluster: "prod", ServiceUID: "uid-2", Port: "http"}},
+		{name: "other port", other: objectOwner{Cluster: "prod", ServiceUID: "uid-1", Port: "https"}},
+	}
+
+	for _, test := range tests {
+		if actual := owner.matches(test.other); actual != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestCheckOwnership(t *testing.T) {
+	service := testService("web", 80)
+
+	tests := []struct {
+		name        string
+		description string
+		foreign     bool
+		ownedBy     bool
+	}{
+		{name: "own vServer", description: objectOwner{Cluster: "prod", ServiceUID: "uid-web"}.describe(VirtualServerDescription), ownedBy: true},
+		{name: "own pool", description: objectOwner{Cluster: "prod", ServiceUID: "uid-web"}.describe(PoolDescription), ownedBy: true},
+		{name: "own NAT rule", description: objectOwner{Cluster: "prod", ServiceUID: "uid-web"}.describe(NatRuleDescription), ownedBy: true},
+		{name: "untagged legacy object is adopted", description: VirtualServerDescription},
+		{name: "legacy object tagged without cluster", description: objectOwner{ServiceUID: "uid-web"}.describe(PoolDescription), ownedBy: true},
+		{name: "other Service of this cluster", description: objectOwner{Cluster: "prod", ServiceUID: "uid-other"}.describe(VirtualServerDescription)},
+		{name: "foreign cluster", description: objectOwner{Cluster: "prod_eu", ServiceUID: "uid-web"}.describe(VirtualServerDescription), foreign: true},
+		{name: "not created by us", description: "created by hand", foreign: true},
+		{name: "no description", description: "", foreign: true},
+		{name: "marker without our description", description: objectOwner{Cluster: "prod", ServiceUID: "uid-web"}.describe("custom"), foreign: true, ownedBy: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkOwnership("prod", "object", test.description)
+			if test.foreign && !errors.Is(err, ErrForeignObject) {
+				t.Errorf("expected ErrForeignObject, got %v", err)
+			}
+			if !test.foreign && err != nil {
+				t.Errorf("expected the object to be ours, got %s", err)
+			}
+			if actual := isOwnedBy("prod", test.description, service); actual != test.ownedBy {
+				t.Errorf("expected isOwnedBy to be %t", test.ownedBy)
+			}
+		})
+	}
+}
+
+func TestCheckFirewallRuleOwnership(t *testing.T) {
+	vservers := []*types.LbVirtualServer{
+		{Name: "own", IpAddress: "10.13.37.3", Description: objectOwner{Cluster: "prod", ServiceUID: "uid-web"}.describe(VirtualServerDescription)},
+		{Name: "legacy", IpAddress: "10.13.37.4", Description: VirtualServerDescription},
+		{Name: "foreign", IpAddress: "10.13.37.5", Description: objectOwner{Cluster: "prod_eu", ServiceUID: "uid-web"}.describe(VirtualServerDescription)},
+		{Name: "manual", IpAddress: "10.13.37.6", Description: "created by hand"},
+	}
+
+	tests := []struct {
+		name         string
+		destinations []string
+		foreign      bool
+	}{
+		{name: "own vServer", destinations: []string{"10.13.37.3"}},
+		{name: "legacy vServer", destinations: []string{"10.13.37.4"}},
+		{name: "address without vServer", destinations: []string{"192.0.2.1"}},
+		{name: "no destination"},
+		{name: "foreign vServer", destinations: []string{"10.13.37.5"}, foreign: true},
+		{name: "vServer not created by us", destinations: []string{"10.13.37.6"}, foreign: true},
+		{name: "one of several destinations is foreign", destinations: []string{"10.13.37.3", "10.13.37.5"}, foreign: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &types.EdgeFirewallRule{Name: "rule", Destination: types.EdgeFirewallEndpoint{IpAddresses: test.destinations}}
+			err := checkFirewallRuleOwnership("prod", rule, vservers)
+			if test.foreign && !errors.Is(err, ErrForeignObject) {
+				t.Errorf("expected ErrForeignObject, got %v", err)
+			}
+			if !test.foreign && err != nil {
+				t.Errorf("expected the rule to be ours, got %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package vcloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+// APIError is an error answer of vCloud or of the NSX API proxied by vCloud
+type APIError struct {
+	StatusCode int
+	// Code is the minor error code of vCloud or the error code of NSX
+	Code    string
+	Message string
+}
+
+// Error keeps the format of govcd errors, so errors of both can be classified the same way
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("API Error: %d: %s (%s)", e.StatusCode, e.Message, e.Code)
+	}
+	return fmt.Sprintf("API Error: %d: %s", e.StatusCode, e.Message)
+}
+
+// Is makes errors.Is(err, ErrNotFound) work for 404 answers
+func (e *APIError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// restClient issues requests for endpoints govcd does not wrap. It uses the session, transport and
+// headers of the govcd client and honours the context of the caller.
+type restClient struct {
+	client *govcd.Client
+	// timeout bounds every single request in addition to the context of the caller
+	timeout time.Duration
+}
+
+func newRESTClient(vcdClient *govcd.VCDClient, timeout time.Duration) *restClient {
+	return &restClient{client: &vcdClient.Client, timeout: timeout}
+}
+
+// get reads href into out
+func (r *restClient) get(ctx context.Context, href string, out interface{}) error {
+	_, err := r.do(ctx, http.MethodGet, href, nil, out)
+	return err
+}
+
+// do sends payload as XML and decodes the answer into out, both may be nil.
+// Answers other than 2xx are returned as *APIError.
+func (r *restClient) do(ctx context.Context, method string, href string, payload interface{}, out interface{}) (*http.Response, error) {
+	u, err := url.ParseRequestURI(href)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URL %s: %s", href, err)
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if payload != nil {
+		data, err := xml.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encode request: %s", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req := r.client.NewRequest(map[string]string{}, method, *u, body).WithContext(ctx)
+	if payload != nil {
+		req.Header.Set("Content-Type", types.AnyXMLMime)
+	}
+
+	resp, err := r.client.Http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response of %s %s: %s", method, u.Path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseAPIError(resp.StatusCode, data)
+	}
+	if out != nil && len(data) > 0 {
+		if err := xml.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("unable to decode response of %s %s: %s", method, u.Path, err)
+		}
+	}
+	return resp, nil
+}
+
+// callWithContext runs a govcd call that does not take a context. The caller returns as soon as ctx is done,
+// the call itself is bounded by the timeout of the HTTP client and finishes in the background.
+// It must only be used for reads on govcd objects of the caller's own, the abandoned call must not touch
+// shared state like cached objects. Changes go through callUntilDone.
+func callWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// callUntilDone runs a govcd call that changes the edge and waits for it to finish even if ctx is done meanwhile.
+// The call can not be cancelled, returning early would release the locks of the caller while the change is
+// still in flight. The call is bounded by the timeout of the HTTP client.
+func callUntilDone(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// parseAPIError reads the vCloud Error or NSX error document of an answer, falling back to the raw body
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: statusCode, Message: http.StatusText(statusCode)}
+
+	var vcdErr types.Error
+	if xml.Unmarshal(body, &vcdErr) == nil && vcdErr.Message != "" {
+		apiErr.Message = vcdErr.Message
+		apiErr.Code = vcdErr.MinorErrorCode
+		return apiErr
+	}
+	var nsxErr types.NSXError
+	if xml.Unmarshal(body, &nsxErr) == nil && nsxErr.Details != "" {
+		apiErr.Message = strings.TrimSpace(nsxErr.ModuleName + " " + nsxErr.Details)
+		apiErr.Code = nsxErr.ErrorCode
+		return apiErr
+	}
+	if text := strings.TrimSpace(string(body)); text != "" {
+		apiErr.Message = text
+	}
+	return apiErr
+}
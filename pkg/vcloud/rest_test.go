@@ -0,0 +1,352 @@
+package vcloud
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+)
+
+func TestParseAPIError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected APIError
+	}{
+		{
+			name:     "vCloud error",
+			status:   http.StatusBadRequest,
+			body:     `<Error xmlns="http://www.vmware.com/vcloud/v1.5" majorErrorCode="400" minorErrorCode="BAD_REQUEST" message="The edge gateway is busy."/>`,
+			expected: APIError{StatusCode: http.StatusBadRequest, Code: "BAD_REQUEST", Message: "The edge gateway is busy."},
+		},
+		{
+			name:     "NSX error",
+			status:   http.StatusBadRequest,
+			body:     `<error><details>Invalid member name: 10.13.37.22</details><errorCode>14571</errorCode><moduleName>vShield Edge</moduleName></error>`,
+			expected: APIError{StatusCode: http.StatusBadRequest, Code: "14571", Message: "vShield Edge Invalid member name: 10.13.37.22"},
+		},
+		{
+			name:     "NSX error without module",
+			status:   http.StatusNotFound,
+			body:     `<error><details>Pool pool-7 not found</details><errorCode>14002</errorCode></error>`,
+			expected: APIError{StatusCode: http.StatusNotFound, Code: "14002", Message: "Pool pool-7 not found"},
+		},
+		{
+			name:     "raw body",
+			status:   http.StatusBadGateway,
+			body:     "  upstream connect error  \n",
+			expected: APIError{StatusCode: http.StatusBadGateway, Message: "upstream connect error"},
+		},
+		{
+			name:     "empty body",
+			status:   http.StatusServiceUnavailable,
+			expected: APIError{StatusCode: http.StatusServiceUnavailable, Message: "Service Unavailable"},
+		},
+		{
+			name:     "XML without a message",
+			status:   http.StatusInternalServerError,
+			body:     `<Error majorErrorCode="500"/>`,
+			expected: APIError{StatusCode: http.StatusInternalServerError, Message: `<Error majorErrorCode="500"/>`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := parseAPIError(test.status, []byte(test.body))
+			if *err != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, *err)
+			}
+		})
+	}
+}
+
+func TestAPIErrorClassification(t *testing.T) {
+	notFound := parseAPIError(http.StatusNotFound, nil)
+	if !errors.Is(notFound, ErrNotFound) {
+		t.Errorf("expected a 404 to be ErrNotFound")
+	}
+	if errors.Is(parseAPIError(http.StatusBadRequest, nil), ErrNotFound) {
+		t.Errorf("expected a 400 not to be ErrNotFound")
+	}
+	if !isUnauthorizedError(parseAPIError(http.StatusUnauthorized, nil)) {
+		t.Errorf("expected a 401 to be recognized as rejected session")
+	}
+	if !isRetryableError(parseAPIError(http.StatusServiceUnavailable, nil)) {
+		t.Errorf("expected a 503 to be retryable")
+	}
+	if isRetryableError(parseAPIError(http.StatusBadRequest, []byte("<error><details>Invalid member name</details><errorCode>14571</errorCode></error>"))) {
+		t.Errorf("expected a validation error not to be retryable")
+	}
+
+	tests := []struct {
+		name            string
+		err             error
+		retryable       bool
+		retryableCreate bool
+	}{
+		{name: "timeout", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: timeoutError{}}, retryable: true},
+		{name: "connection reset", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, retryable: true},
+		{name: "connection refused", err: &url.Error{Op: "Post", URL: "https://vcd/api", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, retryable: true, retryableCreate: true},
+		{name: "unexpected EOF", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: io.ErrUnexpectedEOF}, retryable: true},
+		{name: "other url error", err: &url.Error{Op: "Get", URL: "vcd/api", Err: errors.New("unsupported protocol scheme")}},
+		{name: "unknown authority", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: x509.UnknownAuthorityError{}}},
+		{name: "hostname mismatch", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "vcd"}}},
+		{name: "expired certificate", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.Expired}}},
+		{name: "invalid certificate pointer", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: &x509.CertificateInvalidError{Cert: &x509.Certificate{}, Reason: x509.NotAuthorizedToSign}}},
+		{name: "unknown host", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "vcd", IsNotFound: true}}}},
+		{name: "temporary DNS failure", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "server misbehaving", Name: "vcd", IsTemporary: true}}}, retryable: true},
+		{name: "server error", err: errors.New("API Error: 503: Service Unavailable"), retryable: true},
+		{name: "conflict", err: errors.New("API Error: 409: Conflict"), retryable: true, retryableCreate: true},
+		{name: "busy edge", err: errors.New("edge is busy, try again later"), retryable: true, retryableCreate: true},
+		{name: "cancelled", err: &url.Error{Op: "Get", URL: "https://vcd/api", Err: context.Canceled}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := isRetryableError(test.err); actual != test.retryable {
+				t.Errorf("expected isRetryableError to be %t for %v", test.retryable, test.err)
+			}
+			if actual := isRetryableCreateError(test.err); actual != test.retryableCreate {
+				t.Errorf("expected isRetryableCreateError to be %t for %v", test.retryableCreate, test.err)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// newTestRESTClient returns a restClient for the plain HTTP server handler
+func newTestRESTClient(t *testing.T, handler http.HandlerFunc, timeout time.Duration) (*restClient, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.ParseRequestURI(server.URL + "/api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newRESTClient(govcd.NewVCDClient(*u, false), timeout), server.URL
+}
+
+func TestRESTClientDo(t *testing.T) {
+	var contentType string
+	client, base := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		switch r.URL.Path {
+		case "/pools":
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(`<pool><poolId>pool-7</poolId><name>web</name></pool>`))
+		case "/busy":
+			writeNSXError(w, http.StatusBadRequest, "Edge is busy")
+		case "/garbage":
+			_, _ = w.Write([]byte(`<pool><poolId>`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}, time.Minute)
+
+	var pool types.LbPool
+	if _, err := client.do(context.Background(), http.MethodGet, base+"/pools", nil, &pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.ID != "pool-7" || pool.Name != "web" {
+		t.Errorf("expected pool-7 web, got %s %s", pool.ID, pool.Name)
+	}
+	if contentType != "" {
+		t.Errorf("expected no Content-Type without payload, got %s", contentType)
+	}
+
+	if _, err := client.do(context.Background(), http.MethodPut, base+"/empty", &pool, nil); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != types.AnyXMLMime {
+		t.Errorf("expected Content-Type %s, got %s", types.AnyXMLMime, contentType)
+	}
+
+	_, err := client.do(context.Background(), http.MethodPost, base+"/busy", &pool, nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "4001" {
+		t.Errorf("expected an APIError 400 with code 4001, got %v", err)
+	}
+	if !isRetryableError(err) {
+		t.Errorf("expected a busy edge to be retryable: %s", err)
+	}
+
+	if _, err := client.do(context.Background(), http.MethodGet, base+"/garbage", nil, &pool); err == nil || !strings.Contains(err.Error(), "unable to decode response of GET /garbage") {
+		t.Errorf("expected a decode error, got %v", err)
+	}
+
+	if _, err := client.do(context.Background(), http.MethodGet, "pools", nil, nil); err == nil || !strings.Contains(err.Error(), "invalid request URL") {
+		t.Errorf("expected an invalid URL error, got %v", err)
+	}
+}
+
+func TestRESTClientHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client, base := newTestRESTClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := client.do(ctx, http.MethodGet, base+"/slow", nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if isRetryableError(err) {
+		t.Errorf("expected a cancelled request not to be retried")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the request to return after cancellation, took %s", elapsed)
+	}
+
+	client.timeout = 50 * time.Millisecond
+	_, err = client.do(context.Background(), http.MethodGet, base+"/slow", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request timeout to end the request, got %v", err)
+	}
+}
+
+func TestDoWithLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		expected string
+		err      string
+	}{
+		{name: "absolute path", location: "/network/edges/edge-3/loadbalancer/config/pools/pool-7", expected: "pool-7"},
+		{name: "surrounding whitespace", location: " /network/edges/edge-3/loadbalancer/config/pools/pool-8 ", expected: "pool-8"},
+		{name: "URL", location: "https://vcloud.example.com/network/edges/edge-3/nat/config/rules/196609", expected: "196609"},
+		{name: "missing", err: "answer of POST /loadbalancer/config/pools/ has no Location header"},
+		{name: "blank", location: "  ", err: "has no Location header"},
+		{name: "root", location: "/", err: "has no Location header"},
+	}
+
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodPost || !strings.HasSuffix(r.URL.Path, types.LbServerPoolPath) {
+					return false
+				}
+				if test.location != "" {
+					w.Header().Set("Location", test.location)
+				}
+				w.WriteHeader(http.StatusCreated)
+				return true
+			})
+			edge, err := lb.readEdgeLoadBalancer(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := edge.doWithLocation(http.MethodPost, types.LbServerPoolPath, "error creating pool", &types.LbPool{Name: "web"}, nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != test.expected {
+				t.Errorf("expected ID %s, got %s", test.expected, id)
+			}
+		})
+	}
+}
+
+func TestWithSessionRenewsRejectedSession(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+	service := testService("web", 80)
+
+	if _, _, err := lb.GetLoadBalancer(context.Background(), "cluster", service); err != nil {
+		t.Fatal(err)
+	}
+	f.revokeSessions()
+	if _, _, err := lb.GetLoadBalancer(context.Background(), "cluster", service); err != nil {
+		t.Fatalf("expected the rejected session to be renewed, got %s", err)
+	}
+	if f.loginCount() != 2 {
+		t.Errorf("expected 2 logins, got %d", f.loginCount())
+	}
+
+	//NOTE: A session that is rejected right after the login is not renewed over and over
+	f.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, types.LbConfigPath) {
+			return false
+		}
+		writeVCDError(w, http.StatusUnauthorized, "This operation is denied.")
+		return true
+	})
+	_, _, err := lb.GetLoadBalancer(context.Background(), "cluster", service)
+	if !isUnauthorizedError(err) {
+		t.Errorf("expected the second rejection to be returned, got %v", err)
+	}
+	if f.loginCount() != 3 {
+		t.Errorf("expected a single renewal, got %d logins", f.loginCount())
+	}
+}
+
+func TestWithSessionRenewsWrites(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+
+	edge, err := lb.readEdgeLoadBalancer(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.revokeSessions()
+	pool, err := edge.CreatePool(&types.LbPool{Name: "web", Algorithm: string(ROUND_ROBIN)})
+	if err != nil {
+		t.Fatalf("expected the create to be repeated with a new session, got %s", err)
+	}
+	if pools := f.Pools(); len(pools) != 1 || pools[0].ID != pool.ID {
+		t.Errorf("expected exactly the created pool on the edge, got %d pools", len(pools))
+	}
+	if f.loginCount() != 2 {
+		t.Errorf("expected 2 logins, got %d", f.loginCount())
+	}
+}
+
+func TestResolveObjectsRenewsRejectedSession(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+	service := testService("web", 80)
+
+	if _, _, err := lb.GetLoadBalancer(context.Background(), "cluster", service); err != nil {
+		t.Fatal(err)
+	}
+	//NOTE: govcd reports a rejected org lookup as not found, the session must be renewed nevertheless
+	f.revokeSessions()
+	cachedVCDObjects.invalidate("test")
+	if _, _, err := lb.GetLoadBalancer(context.Background(), "cluster", service); err != nil {
+		t.Fatalf("expected the rejected session to be renewed, got %s", err)
+	}
+	if f.loginCount() != 2 {
+		t.Errorf("expected 2 logins, got %d", f.loginCount())
+	}
+}
@@ -0,0 +1,171 @@
+package vcloud
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+var (
+	// defaultRetryBackoff is used for transient vCloud errors: up to 6 attempts within roughly a minute
+	defaultRetryBackoff = wait.Backoff{
+		Duration: 1 * time.Second,
+		Factor:   2,
+		Jitter:   0.5,
+		Steps:    6,
+		Cap:      20 * time.Second,
+	}
+
+	// apiErrorStatus extracts the HTTP status of a vCloud API error, e.g. "API Error: 503: ..."
+	apiErrorStatus = regexp.MustCompile(`API Error: (\d{3}):`)
+
+	// transientMessages are parts of vCloud and NSX error messages that indicate the request can be repeated
+	transientMessages = []string{
+		"busy",
+		"concurrent",
+		"another operation",
+		"try again",
+		"temporarily unavailable",
+		"connection reset",
+		"connection refused",
+	}
+
+	// rejectedMessages are the transientMessages that show a request was not applied
+	rejectedMessages = []string{
+		"busy",
+		"concurrent",
+		"another operation",
+		"try again",
+		"connection refused",
+	}
+)
+
+// isRetryableError classifies errors returned by govcd. Busy edges, concurrent modifications, throttling,
+// server errors, timeouts and lost connections are retryable, everything else is permanent.
+// Rejected certificates and failed DNS lookups do not go away by themselves.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if isCertificateError(err) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary
+	}
+	//NOTE: Every *url.Error is a net.Error, only timeouts are worth repeating
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	message := err.Error()
+	if match := apiErrorStatus.FindStringSubmatch(message); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		if status >= http.StatusInternalServerError || status == http.StatusConflict || status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	message = strings.ToLower(message)
+	for _, transient := range transientMessages {
+		if strings.Contains(message, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCertificateError reports whether the TLS certificate of vCloud was rejected, repeating the request does not help
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var invalidPtr *x509.CertificateInvalidError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) || errors.As(err, &invalidPtr)
+}
+
+// isRetryableCreateError classifies errors of requests that create objects. Only answers that show vCloud
+// rejected the request are retried. After a timeout, a lost connection or a server error the object may have
+// been created, repeating the request would create a duplicate. The next reconcile finds it by name instead.
+func isRetryableCreateError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isCertificateError(err) {
+		return false
+	}
+	//NOTE: A refused connection never reached vCloud
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	message := err.Error()
+	if match := apiErrorStatus.FindStringSubmatch(message); match != nil {
+		status, _ := strconv.Atoi(match[1])
+		if status == http.StatusConflict || status == http.StatusTooManyRequests {
+			return true
+		}
+		if status >= http.StatusInternalServerError {
+			return false
+		}
+	}
+	message = strings.ToLower(message)
+	for _, rejected := range rejectedMessages {
+		if strings.Contains(message, rejected) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryOnTransientError calls fn until it succeeds, fails with a permanent error or the backoff is exhausted.
+// It stops waiting as soon as ctx is done and returns the last error of fn.
+func retryOnTransientError(ctx context.Context, operation string, fn func() error) error {
+	return retry(ctx, operation, isRetryableError, fn)
+}
+
+// retryOnRejection behaves like retryOnTransientError for requests that must not be repeated unless
+// vCloud rejected them, e.g. creates
+func retryOnRejection(ctx context.Context, operation string, fn func() error) error {
+	return retry(ctx, operation, isRetryableCreateError, fn)
+}
+
+func retry(ctx context.Context, operation string, retryable func(error) bool, fn func() error) error {
+	backoff := defaultRetryBackoff
+	for {
+		err := observeAPICall(operation, fn)
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if backoff.Steps <= 1 {
+			retriesExhausted.WithLabelValues(operation).Inc()
+			return fmt.Errorf("giving up after %d attempts: %w", defaultRetryBackoff.Steps, err)
+		}
+		delay := backoff.Step()
+		retries.WithLabelValues(operation).Inc()
+		klog.V(4).Infof("%s failed with a transient error, retrying in %s: %s", operation, delay, err.Error())
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
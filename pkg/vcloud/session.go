@@ -2,12 +2,16 @@ package vcloud
 
 import (
 	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"k8s.io/klog"
 	"sync"
 	"time"
 )
 
 type cachedConnection struct {
-	initTime   time.Time
+	initTime time.Time
+	// expiresAt is set if vCloud told us when the session ends
+	expiresAt  time.Time
 	connection *govcd.VCDClient
 }
 
@@ -25,3 +29,61 @@ func (c *cacheStorage) reset() {
 	c.cacheClientServedCount = 0
 	c.conMap = make(map[string]cachedConnection)
 }
+
+// resolvedObjects holds the VDC and Edge Gateway resolved with a specific client. Only the raw types are cached,
+// govcd objects are changed by their own methods and must not be shared between goroutines.
+type resolvedObjects struct {
+	resolvedAt time.Time
+	client     *govcd.VCDClient
+	vdc        types.Vdc
+	edge       types.EdgeGateway
+}
+
+// newVDC returns a VDC of its own for the caller
+func (o *resolvedObjects) newVDC() *govcd.Vdc {
+	vdc := govcd.NewVdc(&o.client.Client)
+	raw := o.vdc
+	vdc.Vdc = &raw
+	return vdc
+}
+
+// newEdgeGateway returns an Edge Gateway of its own for the caller
+func (o *resolvedObjects) newEdgeGateway() *govcd.EdgeGateway {
+	edge := govcd.NewEdgeGateway(&o.client.Client)
+	raw := o.edge
+	edge.EdgeGateway = &raw
+	return edge
+}
+
+// objectCache caches resolved objects on top of the connection cache. Entries are keyed by org, vdc and edge name
+// and are only valid for the client they were resolved with, a new session always resolves them again.
+type objectCache struct {
+	entries map[string]*resolvedObjects
+	ttl     time.Duration
+	sync.Mutex
+}
+
+func newObjectCache(ttl time.Duration) *objectCache {
+	return &objectCache{entries: make(map[string]*resolvedObjects), ttl: ttl}
+}
+
+// get returns the cached objects if they are still valid for the client
+func (c *objectCache) get(key string, client *govcd.VCDClient) (*resolvedObjects, bool) {
+	entry, ok := c.entries[key]
+	if !ok || entry.client != client || time.Since(entry.resolvedAt) > c.ttl {
+		return nil, false
+	}
+	return entry, true
+}
+
+// invalidate drops all cached objects
+func (c *objectCache) invalidate(reason string) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) == 0 {
+		return
+	}
+	klog.V(4).Infof("Invalidating cached vCloud objects: %s", reason)
+	objectCacheInvalidations.WithLabelValues(reason).Inc()
+	c.entries = make(map[string]*resolvedObjects)
+}
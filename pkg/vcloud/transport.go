@@ -0,0 +1,122 @@
+package vcloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/govcd"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// tlsVersions maps the minTLSVersion values of the cloud-config to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS settings for the vCloud endpoint from the cloud-config
+func (v *vCloud) newTLSConfig() (*tls.Config, error) {
+	cfg := v.cfg.TLS
+	tlsConfig := &tls.Config{InsecureSkipVerify: v.cfg.Insecure}
+
+	if cfg.MinVersion != "" {
+		version, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls.minVersion %q", cfg.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if cfg.CAFile != "" || cfg.CAData != "" {
+		//NOTE: The system roots stay trusted, the bundle only adds the private CA
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read tls.caFile: %s", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("tls.caFile %s contains no PEM encoded certificate", cfg.CAFile)
+			}
+		}
+		if cfg.CAData != "" && !pool.AppendCertsFromPEM([]byte(cfg.CAData)) {
+			return nil, fmt.Errorf("tls.caData contains no PEM encoded certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// proxyFunc returns how requests to vCloud are proxied. Without a proxy in the cloud-config
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY of the environment are used.
+func (v *vCloud) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if v.cfg.Proxy.URL == "" {
+		return http.ProxyFromEnvironment
+	}
+	noProxy := v.cfg.Proxy.NoProxy
+	if noProxy == "" {
+		noProxy = os.Getenv("NO_PROXY")
+	}
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	proxy := (&httpproxy.Config{
+		HTTPProxy:  v.cfg.Proxy.URL,
+		HTTPSProxy: v.cfg.Proxy.URL,
+		NoProxy:    noProxy,
+	}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// newTransport builds the transport used for every request to vCloud
+func (v *vCloud) newTransport() (*http.Transport, error) {
+	tlsConfig, err := v.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		Proxy:               v.proxyFunc(),
+		TLSHandshakeTimeout: 120 * time.Second,
+	}, nil
+}
+
+// withTimeout bounds every request govcd sends
+func withTimeout(timeout time.Duration) govcd.VCDClientOption {
+	return func(client *govcd.VCDClient) error {
+		if timeout > 0 {
+			client.Client.Http.Timeout = timeout
+		}
+		return nil
+	}
+}
+
+// withTransport makes govcd use our transport instead of its default one
+func withTransport(transport *http.Transport) govcd.VCDClientOption {
+	return func(client *govcd.VCDClient) error {
+		client.Client.Http.Transport = transport
+		return nil
+	}
+}
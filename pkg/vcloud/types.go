@@ -1,8 +1,11 @@
 package vcloud
 
 import (
+	"encoding/json"
 	"encoding/xml"
+	"fmt"
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	"time"
 )
 
 type LbProtocol string
@@ -47,9 +50,118 @@ type FirewallConfig struct {
 	Source      types.EdgeFirewallEndpoint
 	Destination types.EdgeFirewallEndpoint
 	Application types.EdgeFirewallApplication
+	// Action defaults to Accept
+	Action         string
+	LoggingEnabled bool
+}
+
+// Duration is a time.Duration that is written as a string like "10m" in the cloud-config
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s: %s", string(b), err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type GarbageCollectorConfig struct {
+	// Enabled starts a periodic cleanup of edge objects whose Service no longer exists
+	Enabled bool `yaml:"enabled"`
+	// Interval between two runs, defaults to 10m
+	Interval Duration `yaml:"interval"`
+	// DryRun only reports orphaned objects instead of deleting them
+	DryRun bool `yaml:"dryRun"`
+}
+
+type TLSConfig struct {
+	// CAFile is a PEM bundle of additional CAs trusted for the vCloud endpoint
+	CAFile string `yaml:"caFile"`
+	// CAData is the same as CAFile with the PEM written inline
+	CAData string `yaml:"caData"`
+	// MinVersion is the lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"minVersion"`
+	// CertFile and KeyFile are an optional client certificate presented to vCloud
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type ProxyConfig struct {
+	// URL of the proxy for all requests to vCloud, e.g. http://proxy.example.com:3128
+	URL string `yaml:"url"`
+	// NoProxy is a comma separated list of hosts reached directly, defaults to NO_PROXY
+	NoProxy string `yaml:"noProxy"`
+}
+
+type NetworkConfig struct {
+	// Name of the VDC network the IP addresses of internal load balancers are taken from
+	Name string `yaml:"name" env:"VCLOUD_VDC_NETWORK_NAME"`
+	// IPNet is the CIDR of that network, e.g. 10.13.37.0/24
+	IPNet string `yaml:"ipNet" env:"VCLOUD_VDC_NETWORK_IPNET"`
+}
+
+type InternalFirewallConfig struct {
+	// Enabled creates firewall rules for internal load balancers as well, the mk.plus.io/firewall-internal annotation overrides it
+	Enabled bool `yaml:"enabled"`
+	// Sources are the networks allowed to reach internal load balancers, e.g. other Org networks.
+	// loadBalancerSourceRanges of a Service take precedence, without both any source is allowed.
+	Sources []string `yaml:"sources"`
+}
+
+type FirewallPolicyConfig struct {
+	// DenyByDefault adds a rule below the rule of every external load balancer that drops all sources
+	// not listed in loadBalancerSourceRanges, the mk.plus.io/firewall-deny-by-default annotation overrides it
+	DenyByDefault bool `yaml:"denyByDefault"`
+	// AnchorRule is the name of an existing rule, new rules are created right above it instead of at the end of the user rules
+	AnchorRule string `yaml:"anchorRule"`
+	// Internal configures firewall rules for internal load balancers, which get none by default
+	Internal InternalFirewallConfig `yaml:"internal"`
+	// Logging enables logging of all managed rules, the mk.plus.io/firewall-logging annotation overrides it
+	Logging bool `yaml:"logging"`
+	// IPSet is the name of an IP set that collects the addresses of all load balancers,
+	// the mk.plus.io/firewall-ip-set annotation overrides it
+	IPSet string `yaml:"ipSet"`
+}
+
+type TimeoutConfig struct {
+	// Request bounds a single request to vCloud, defaults to 1m
+	Request Duration `yaml:"request"`
+	// Operation bounds a whole call of the controller manager like EnsureLoadBalancer including retries, defaults to 5m
+	Operation Duration `yaml:"operation"`
+}
+
+type CredentialsConfig struct {
+	// Path is a directory with one file per key (user, password, apiToken, bearerToken) as mounted for a Secret,
+	// or a YAML file holding these keys
+	Path string `yaml:"path"`
+	// SecretName is a Secret holding the same keys, it takes precedence over Path
+	SecretName string `yaml:"secretName"`
+	// SecretNamespace defaults to kube-system
+	SecretNamespace string `yaml:"secretNamespace"`
+	// ReloadInterval is how often all sources are reloaded in case a change was missed, defaults to 1m.
+	// The Secret is watched and reloaded as soon as it changes.
+	ReloadInterval Duration `yaml:"reloadInterval"`
 }
 
 type Config struct {
+	// AuthMethod selects how to log into vCloud: password (default), apiToken or bearerToken
+	AuthMethod string `yaml:"authMethod"`
+	// APIToken is a vCloud API token, used with authMethod apiToken
+	APIToken string `yaml:"apiToken"`
+	// BearerToken is a pre-issued access token, used with authMethod bearerToken
+	BearerToken string `yaml:"bearerToken"`
 	User        string `yaml:"user"`
 	Password    string `yaml:"password"`
 	Org         string `yaml:"org"`
@@ -57,4 +169,23 @@ type Config struct {
 	VDC         string `yaml:"vdc"`
 	Insecure    bool   `yaml:"insecure"`
 	EdgeGateway string `yaml:"edgeGateway"`
+	// TLS configures how the vCloud endpoint is verified, Insecure disables the verification
+	TLS TLSConfig `yaml:"tls"`
+	// Proxy for requests to vCloud, HTTPS_PROXY and NO_PROXY are used if it is empty
+	Proxy ProxyConfig `yaml:"proxy"`
+	// SessionTTL is how long a vCloud session is reused before logging in again, defaults to 20m.
+	// Sessions rejected by vCloud earlier are replaced right away.
+	SessionTTL Duration `yaml:"sessionTTL"`
+	// ClusterName has to match the --cluster-name of the controller manager. It is optional, the garbage collector
+	// learns the name from the load balancer calls and only uses this value until the first call
+	ClusterName      string                 `yaml:"clusterName"`
+	GarbageCollector GarbageCollectorConfig `yaml:"garbageCollector"`
+	// Credentials are optional sources for user, password and tokens that override the values above
+	Credentials CredentialsConfig `yaml:"credentials"`
+	// Network is used to allocate IP addresses of internal load balancers
+	Network NetworkConfig `yaml:"network"`
+	// Timeouts of requests to vCloud and of whole operations
+	Timeouts TimeoutConfig `yaml:"timeouts"`
+	// Firewall configures the rules created for load balancers
+	Firewall FirewallPolicyConfig `yaml:"firewall"`
 }
@@ -18,8 +18,9 @@ func contains(s []string, e string) bool {
 }
 
 //TODO: Check if this works as expected
+//NOTE: Name is ignored so members created under an older naming scheme are still recognized
 func comparePoolMember(a *types.LbPoolMember, b *types.LbPoolMember) bool {
-	return cmp.Equal(*a, *b, cmpopts.IgnoreFields(types.LbPoolMember{}, "ID"))
+	return cmp.Equal(*a, *b, cmpopts.IgnoreFields(types.LbPoolMember{}, "ID", "Name"))
 }
 
 func getPoolMemberFromArray(s types.LbPoolMembers, e *types.LbPoolMember) *types.LbPoolMember {
@@ -31,6 +32,22 @@ func getPoolMemberFromArray(s types.LbPoolMembers, e *types.LbPoolMember) *types
 	return nil
 }
 
+//reconcilePoolMembers returns the desired members, reusing existing entries so their IDs are kept,
+//and whether the result differs from the existing members
+func reconcilePoolMembers(existing types.LbPoolMembers, desired types.LbPoolMembers) (types.LbPoolMembers, bool) {
+	changed := len(existing) != len(desired)
+	result := make(types.LbPoolMembers, 0, len(desired))
+	for i := range desired {
+		if member := getPoolMemberFromArray(existing, &desired[i]); member != nil {
+			result = append(result, *member)
+		} else {
+			result = append(result, desired[i])
+			changed = true
+		}
+	}
+	return result, changed
+}
+
 func memberExists(s types.LbPoolMembers, e *types.LbPoolMember) bool {
 	for _, a := range s {
 		if comparePoolMember(&a, e) {
@@ -40,19 +57,19 @@ func memberExists(s types.LbPoolMembers, e *types.LbPoolMember) bool {
 	return false
 }
 
-// vCloud only supports max 256 Characters
-func cutString(original string) string {
-	ret := original
-	if len(original) > 255 {
-		ret = original[:255]
-	}
-	return ret
-}
-
 func validateNetwork(ipnet string) (net.IP, *net.IPNet, error) {
 	return net.ParseCIDR(ipnet)
 }
 
+//isInNetwork reports whether ip is part of the network given in CIDR notation
+func isInNetwork(ip string, ipnet string) bool {
+	_, network, err := validateNetwork(ipnet)
+	if err != nil {
+		return false
+	}
+	return network.Contains(net.ParseIP(ip))
+}
+
 func IsIpInRange(testIp string, startIp string, endIp string) bool {
 	trial := net.ParseIP(testIp)
 	if trial.To4() == nil {
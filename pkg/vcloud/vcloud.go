@@ -2,12 +2,16 @@ package vcloud
 
 import (
 	"fmt"
-	"github.com/ghodss/yaml"
 	"io"
 	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
-	"os"
 )
 
 const (
@@ -15,7 +19,13 @@ const (
 )
 
 type vCloud struct {
-	cfg *Config
+	cfg             *Config
+	credentialStore *credentialStore
+	loadBalancer    *LB
+	kubeClient      kubernetes.Interface
+	eventRecorder   record.EventRecorder
+	// credentialsSecrets caches the watched credentials Secret, it is nil until the watch is synced
+	credentialsSecrets cache.Store
 }
 
 type LoadBalancerOptions struct {
@@ -23,29 +33,42 @@ type LoadBalancerOptions struct {
 }
 
 func (v *vCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
+	v.kubeClient = clientBuilder.ClientOrDie("vcloud-cloud-provider")
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v.kubeClient.CoreV1().Events("")})
+	v.eventRecorder = eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "vcloud-cloud-controller-manager"})
+
+	if v.hasCredentialSources() {
+		if err := v.loadCredentials(); err != nil {
+			klog.Errorf("loading vCloud credentials failed: %s", err)
+		} else if v.cfg.Credentials.SecretName != "" {
+			if err := v.preflight(); err != nil {
+				klog.Errorf("vCloud preflight check failed: %s", err)
+			}
+		}
+		interval := v.cfg.Credentials.ReloadInterval.Duration
+		if interval <= 0 {
+			interval = defaultCredentialsReloadInterval
+		}
+		go v.watchCredentials(interval, stop)
+	}
+
+	if v.cfg.GarbageCollector.Enabled {
+		interval := v.cfg.GarbageCollector.Interval.Duration
+		if interval <= 0 {
+			interval = defaultGarbageCollectionInterval
+		}
+		gc := newGarbageCollector(v.loadBalancer, v.kubeClient, v.cfg.ClusterName, v.cfg.GarbageCollector.DryRun)
+		go gc.Run(interval, stop)
+	}
 }
 
 func (v *vCloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 	klog.V(4).Info("vCloud.LoadBalancerOptions() called")
 
-	// Starts Caching
-	_, err := v.getClient(false)
-	if err != nil {
-		klog.Error(err)
-		os.Exit(1)
-	}
-
-	_, err = v.getEdgeGateway(v.cfg.Org, v.cfg.VDC, v.cfg.EdgeGateway)
-	if err != nil {
-		klog.Errorf("Can not find Edge Gateway under name: ", v.cfg.EdgeGateway)
-		os.Exit(1)
-	}
-
-	return &LB{
-		vCloud:              v,
-		LoadBalancerOptions: LoadBalancerOptions{LBVersion: "v123"},
-		keyLock:             nil,
-	}, true
+	return v.loadBalancer, true
 }
 
 func (v *vCloud) Instances() (cloudprovider.Instances, bool) {
@@ -73,8 +96,29 @@ func (v *vCloud) HasClusterID() bool {
 }
 
 func newVCloud(cfg *Config) (*vCloud, error) {
+	cfg.setDefaults()
+	registerMetrics()
+
 	vcloud := vCloud{
-		cfg: cfg,
+		cfg:             cfg,
+		credentialStore: &credentialStore{},
+	}
+	//NOTE: A Secret can only be read after Initialize, it is loaded there
+	if cfg.Credentials.Path != "" {
+		values, err := readCredentialsPath(cfg.Credentials.Path)
+		if err != nil {
+			return nil, err
+		}
+		c := vcloud.inlineCredentials()
+		c.apply(values)
+		vcloud.credentialStore.set(c)
+	} else {
+		vcloud.credentialStore.set(vcloud.inlineCredentials())
+	}
+	vcloud.loadBalancer = &LB{
+		vCloud:              &vcloud,
+		LoadBalancerOptions: LoadBalancerOptions{LBVersion: "v123"},
+		keyLock:             newKeyLock(),
 	}
 
 	return &vcloud, nil
@@ -93,11 +137,23 @@ func ReadConfig(config io.Reader) (*Config, error) {
 		return nil, fmt.Errorf("error reading cloud-config: %s", err)
 	}
 
-	err = yaml.Unmarshal(file, &cfg)
+	err = unmarshalStrict(file, &cfg)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshelling cloud-config: %s", err)
 	}
 
+	//NOTE: Precedence from lowest to highest: defaults, cloud-config, VCLOUD_* environment, credentials sources
+	err = applyProcessEnvOverrides(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cloud-config from environment: %s", err)
+	}
+
+	cfg.setDefaults()
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cloud-config: %s", err)
+	}
+
 	klog.V(5).Infof("Config, loaded from cloud-config")
 
 	return &cfg, nil
@@ -112,8 +168,15 @@ func init() {
 		cloud, err := newVCloud(cfg)
 		if err != nil {
 			klog.V(1).Infof("New vCloud client created failed with config")
+			return nil, err
+		}
+		//NOTE: Credentials from a Secret are only available after Initialize, the check runs there
+		if cfg.Credentials.SecretName == "" {
+			if err := cloud.preflight(); err != nil {
+				return nil, fmt.Errorf("vCloud preflight check failed: %s", err)
+			}
 		}
-		return cloud, err
+		return cloud, nil
 	})
 	klog.V(1).Infof("Registered cloud provider with name: %s", ProviderName)
 }
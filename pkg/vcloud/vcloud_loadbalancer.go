@@ -7,10 +7,12 @@ import (
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/klog"
+	"net"
 	nodeutil "k8s.io/kubernetes/pkg/util/node"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,12 +24,49 @@ const (
 	LoadBalancerPoolAlgorithm            = "mk.plus.io/pool-algorithm"
 	LoadBalancerPoolMemberMinConnections = "mk.plus.io/pool-min-con"
 	LoadBalancerPoolMemberMaxConnections = "mk.plus.io/pool-max-con"
+	LoadBalancerFirewallDenyByDefault    = "mk.plus.io/firewall-deny-by-default"
+	LoadBalancerFirewallInternal         = "mk.plus.io/firewall-internal"
+	LoadBalancerFirewallLogging          = "mk.plus.io/firewall-logging"
+	LoadBalancerFirewallIPSet            = "mk.plus.io/firewall-ip-set"
 )
 
 type LB struct {
-	vCloud *vCloud
+	// edgeWrites counts the changes to the edge, it comes first to be 64-bit aligned for atomic access
+	edgeWrites uint64
+	vCloud     *vCloud
 	LoadBalancerOptions
 	keyLock *keyLock
+	// clusterName is the last --cluster-name the load balancer methods were called with
+	clusterName atomic.Value
+	// features holds the serviceFeatures applied by the last successful EnsureLoadBalancer per Service UID
+	features sync.Map
+}
+
+// serviceFeatures records which edge objects besides vServers and pools a Service uses
+type serviceFeatures struct {
+	nat      bool
+	firewall bool
+	ipSet    bool
+}
+
+//appliedFeatures returns the features the last successful EnsureLoadBalancer applied for the Service. Without a record,
+//e.g. after a restart, every feature is reported as applied so leftovers of all of them are looked for once.
+func (loadBalancer *LB) appliedFeatures(service *corev1.Service) serviceFeatures {
+	if features, ok := loadBalancer.features.Load(service.UID); ok {
+		return features.(serviceFeatures)
+	}
+	return serviceFeatures{nat: true, firewall: true, ipSet: true}
+}
+
+//observeClusterName remembers the cluster name passed by the service controller for the garbage collector
+func (loadBalancer *LB) observeClusterName(clusterName string) {
+	loadBalancer.clusterName.Store(clusterName)
+}
+
+//observedClusterName returns the cluster name of the last load balancer call, it is empty before the first call
+func (loadBalancer *LB) observedClusterName() string {
+	name, _ := loadBalancer.clusterName.Load().(string)
+	return name
 }
 
 //getStringFromServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
@@ -54,22 +93,34 @@ func getIntFromServiceAnnotation(service *corev1.Service, annotationKey string)
 
 func (loadBalancer *LB) GetLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service) (status *corev1.LoadBalancerStatus, exists bool, err error) {
 	klog.V(4).Infof("GetLoadBalancer: called with clusterName %s", clusterName)
-	name := loadBalancer.GetLoadBalancerName(ctx, clusterName, service)
+	loadBalancer.observeClusterName(clusterName)
+	ctx, cancel := loadBalancer.withOperationTimeout(ctx)
+	defer cancel()
 	status = &corev1.LoadBalancerStatus{}
 
-	for _, port := range service.Spec.Ports {
+	edge, err := loadBalancer.readEdgeLoadBalancer(ctx)
+	if err != nil {
+		klog.V(4).Infof("Error fetching loadBalancers err: %s", err.Error())
+		return nil, false, err
+	}
 
-		lbName := fmt.Sprintf("%s-%d", name, port.NodePort)
-		lb, err := loadBalancer.GetLoadBalancerByName(lbName)
-		if errors.Is(ErrNotFound, err) {
-			klog.V(4).Infof("Could not find loadBalancer by name: %s", lbName)
-			return nil, false, err
-		} else if err != nil {
-			klog.V(4).Infof("Error fetching loadBalancer by name: %s err: %s", lbName, err.Error())
+	for _, port := range service.Spec.Ports {
+		lb, err := findVirtualServer(clusterName, edge.VirtualServers, ownerFor(clusterName, service, port),
+			virtualServerName(clusterName, service, port),
+			legacyVirtualServerName(clusterName, service, port.NodePort))
+		if err != nil {
 			return nil, false, err
 		}
+		if lb == nil {
+			klog.V(4).Infof("Could not find loadBalancer for port: %s", portKey(port))
+			return nil, false, nil
+		}
 
-		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: lb.IpAddress})
+		ip := lb.IpAddress
+		if publicIP := natPublicIP(service); publicIP != "" {
+			ip = publicIP
+		}
+		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: ip})
 	}
 
 	return status, true, nil
@@ -77,16 +128,86 @@ func (loadBalancer *LB) GetLoadBalancer(ctx context.Context, clusterName string,
 
 func (loadBalancer *LB) GetLoadBalancerName(ctx context.Context, clusterName string, service *corev1.Service) string {
 	klog.V(4).Infof("GetLoadBalancerName: called with clusterName %s", clusterName)
-	name := fmt.Sprintf("kube_service_%s_%s_%s", clusterName, service.Namespace, service.Name)
+	name := serviceBaseName(clusterName, service)
 	klog.V(4).Infof("GetLoadBalancerName: registered Name: %s", name)
-	return cutString(name)
+	return name
 }
 
-func (loadBalancer *LB) getPoolName(ctx context.Context, clusterName string, service *corev1.Service, nodePort int32) string {
+func (loadBalancer *LB) getPoolName(ctx context.Context, clusterName string, service *corev1.Service, port corev1.ServicePort) string {
 	klog.V(4).Infof("getPoolName: called with clusterName %s", clusterName)
-	name := fmt.Sprintf("kube_pool_%s_%s_%s_%d", clusterName, service.Namespace, service.Name, nodePort)
+	name := poolName(clusterName, service, port)
 	klog.V(4).Infof("getPoolName: registered Name: %s", name)
-	return cutString(name)
+	return name
+}
+
+//validateObjectNames checks every name the Service would create on the edge before any API call is made
+func (loadBalancer *LB) validateObjectNames(ctx context.Context, clusterName string, service *corev1.Service) error {
+	names := []string{loadBalancer.GetLoadBalancerName(ctx, clusterName, service), firewallRuleName(clusterName, service), firewallDenyRuleName(clusterName, service)}
+	for _, port := range service.Spec.Ports {
+		names = append(names,
+			virtualServerName(clusterName, service, port),
+			loadBalancer.getPoolName(ctx, clusterName, service, port),
+		)
+	}
+	for _, name := range names {
+		if err := ValidateObjectName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//findVirtualServer looks up the vServer of a ServicePort by its ownership metadata first and falls back to the given names.
+//A vServer found by name that belongs to another cluster or was not created by us is reported as ErrForeignObject.
+func findVirtualServer(clusterName string, vservers []*types.LbVirtualServer, owner objectOwner, names ...string) (*types.LbVirtualServer, error) {
+	for _, vserver := range vservers {
+		if o, ok := parseOwner(vserver.Description); ok && owner.matches(o) {
+			return vserver, nil
+		}
+	}
+	for _, vserver := range vservers {
+		if contains(names, vserver.Name) {
+			if err := checkOwnership(clusterName, vserver.Name, vserver.Description); err != nil {
+				return nil, err
+			}
+			return vserver, nil
+		}
+	}
+	return nil, nil
+}
+
+//findPool looks up the pool of a ServicePort the same way findVirtualServer does
+func findPool(clusterName string, pools []*types.LbPool, owner objectOwner, names ...string) (*types.LbPool, error) {
+	for _, pool := range pools {
+		if o, ok := parseOwner(pool.Description); ok && owner.matches(o) {
+			return pool, nil
+		}
+	}
+	for _, pool := range pools {
+		if contains(names, pool.Name) {
+			if err := checkOwnership(clusterName, pool.Name, pool.Description); err != nil {
+				return nil, err
+			}
+			return pool, nil
+		}
+	}
+	return nil, nil
+}
+
+//desiredPoolMembers returns one member per worker node for the given ServicePort
+func (loadBalancer *LB) desiredPoolMembers(port corev1.ServicePort, service *corev1.Service, nodes []*corev1.Node) (types.LbPoolMembers, error) {
+	var members types.LbPoolMembers
+	for _, node := range nodes {
+		if node.Labels[IsWorkerNode] == "true" {
+			//TODO: implement service monitors
+			member, err := loadBalancer.createMember(port, service, node)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, *member)
+		}
+	}
+	return members, nil
 }
 
 func (loadBalancer *LB) createMember(port corev1.ServicePort, service *corev1.Service, node *corev1.Node) (*types.LbPoolMember, error) {
@@ -95,15 +216,16 @@ func (loadBalancer *LB) createMember(port corev1.ServicePort, service *corev1.Se
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving internal ip or externalIP from node: %s err:%s", node.GetName(), err.Error())
 	}
+	//NOTE: vShield Edge [LoadBalancer] Invalid member name: 10.13.37.22, valid member name should contain letters, digits, dash, underscore and must start with a letter (API error: 14571)
+	memberName := poolMemberName(nodeIp, port.NodePort)
+	if err := ValidateObjectName(memberName); err != nil {
+		return nil, err
+	}
 	minCon, _ := getIntFromServiceAnnotation(service, LoadBalancerPoolMemberMinConnections)
 	maxCon, _ := getIntFromServiceAnnotation(service, LoadBalancerPoolMemberMaxConnections)
 
 	member := types.LbPoolMember{
-		//NOTE: vShield Edge [LoadBalancer] Invalid member name: 10.13.37.22, valid member name should contain letters, digits, dash, underscore and must start with a letter (API error: 14571)
-		//TODO: Better naming convention for loadBalancer pool members
-		//NOTE: For now we will use member-10133720-nodePort since dots are not supported.
-		//TODO: Implement Validation for API Error 14571 (valid member name should contain letters, digits, dash, underscore and must start with a letter)
-		Name:        fmt.Sprintf("member-%s-%d", strings.ReplaceAll(nodeIp.String(), ".", ""), port.NodePort),
+		Name:        memberName,
 		IpAddress:   nodeIp.String(),
 		Weight:      1,
 		MonitorPort: int(port.Port),
@@ -117,13 +239,29 @@ func (loadBalancer *LB) createMember(port corev1.ServicePort, service *corev1.Se
 }
 
 func (loadBalancer *LB) EnsureLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (*corev1.LoadBalancerStatus, error) {
+	start := time.Now()
+	status, err := loadBalancer.ensureLoadBalancer(ctx, clusterName, service, nodes)
+	observeReconcile("ensure", start, err)
+	return status, err
+}
+
+func (loadBalancer *LB) ensureLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (*corev1.LoadBalancerStatus, error) {
 	klog.V(4).Infof("EnsureLoadBalancer: called with clusterName %s", clusterName)
+	loadBalancer.observeClusterName(clusterName)
+	ctx, cancel := loadBalancer.withOperationTimeout(ctx)
+	defer cancel()
 	serviceName := loadBalancer.GetLoadBalancerName(ctx, clusterName, service)
+	unlock, err := loadBalancer.lockService(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	var lb *types.LbVirtualServer
 	var vServerIP string
-	var err error
-	var poolUpdateRequired bool
+	//NOTE: A newly allocated address keeps the network locked until its vServers exist
+	releaseNetwork := func() {}
+	defer func() { releaseNetwork() }()
 
 	if len(nodes) == 0 {
 		return nil, fmt.Errorf("there are no available nodes for LoadBalancer service %s", serviceName)
@@ -134,126 +272,240 @@ func (loadBalancer *LB) EnsureLoadBalancer(ctx context.Context, clusterName stri
 		return nil, fmt.Errorf("no ports provided to vCloud load balancer")
 	}
 
+	if err := loadBalancer.validateObjectNames(ctx, clusterName, service); err != nil {
+		return nil, err
+	}
+	if _, err := firewallSources(service, nil); err != nil {
+		return nil, err
+	}
+	if _, err := firewallApplication(service); err != nil {
+		return nil, err
+	}
+
+	//NOTE: The load balancer configuration is read once, all changes below are applied to this copy
+	edge, err := loadBalancer.readEdgeLoadBalancer(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching vCloud lb configuration: %s", err.Error())
+	}
+	defer edge.logRequests("EnsureLoadBalancer", serviceName)
+	defer edge.recordManagedObjects(clusterName)
+
 	//Determine LB Type
-	//NOTE: Defaults to internal loadBalancer
-	if getStringFromServiceAnnotation(service, LoadBalancerType, "internal") == "external" {
+	//NOTE: Defaults to internal loadBalancer, nat uses an internal vServer reached through a DNAT rule from the external IP
+	lbType := getStringFromServiceAnnotation(service, LoadBalancerType, "internal")
+	publicIP := natPublicIP(service)
+	if lbType == "nat" && net.ParseIP(publicIP) == nil {
+		return nil, fmt.Errorf("%s Annotation with a valid IP address is required for nat type Loadbalancer", LoadBalancerExternalIP)
+	}
+	if lbType == "external" {
 		//External LB
 		externalIP := getStringFromServiceAnnotation(service, LoadBalancerExternalIP, "")
 		if externalIP == "" {
 			return nil, fmt.Errorf("%s Annotation is required for external type Loadbalancer", LoadBalancerExternalIP)
 		}
 		vServerIP = externalIP
+	} else if existing := findServiceVirtualServers(edge.VirtualServers, clusterName, service); len(existing) > 0 && existing[0].IpAddress != publicIP && isInNetwork(existing[0].IpAddress, loadBalancer.vCloud.cfg.Network.IPNet) {
+		//NOTE: Keep the address the Service already got, new ports are added on the same IP.
+		//An address outside of network.ipNet is left over from type external and is replaced
+		vServerIP = existing[0].IpAddress
 	} else {
 		//Fetch IP Address of vServer
 		//NOTE: Turns out that you can have multiple vServer on the same IP address but different ports which makes it easier
 		//TODO: Retrieve IPNet from Worker VM via vCloud. Easiest way would be to just label the workers. RKE already adds Internal IP but no Subnet
 		//TODO: Retrieve Network Name somehow maybe labeling?
-		vServerIP, err = loadBalancer.GetNextAvailableIpAddressInVCloudNet(os.Getenv("VCLOUD_VDC_NETWORK_NAME"), os.Getenv("VCLOUD_VDC_NETWORK_IPNET"))
+		networkName := loadBalancer.vCloud.cfg.Network.Name
+		releaseNetwork, err = loadBalancer.lockKey(ctx, lockKindNetwork, networkName)
+		if err != nil {
+			releaseNetwork = func() {}
+			return nil, fmt.Errorf("error waiting for lock of network %s: %s", networkName, err.Error())
+		}
+		//NOTE: vServers created by other Services since the edge was read are not part of its copy
+		inUse, err := edge.VirtualServerAddresses()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching next available ip address: %s", err.Error())
+		}
+		err = retryOnTransientError(ctx, "allocate_ip_address", func() error {
+			var err error
+			vServerIP, err = loadBalancer.GetNextAvailableIpAddressInVCloudNet(ctx, networkName, loadBalancer.vCloud.cfg.Network.IPNet, inUse)
+			return err
+		})
 		if err != nil {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonIPAllocationFailed, "Allocating an IP from network %s failed: %s", networkName, err.Error())
 			return nil, fmt.Errorf("error fetching next available ip address: %s", err.Error())
 		}
+		loadBalancer.recordEvent(service, corev1.EventTypeNormal, EventReasonIPAllocated, "Allocated IP %s from network %s", vServerIP, loadBalancer.vCloud.cfg.Network.Name)
 	}
 
 	for _, port := range ports {
+		owner := ownerFor(clusterName, service, port)
+
 		//NOTE: For every Port we will need a new Pool
-		poolName := loadBalancer.getPoolName(ctx, clusterName, service, port.NodePort)
-		pool, err := loadBalancer.GetLoadBalancerPool(poolName)
-		if err != nil && !errors.Is(err, ErrNotFound) {
-			return nil, fmt.Errorf("error retrieving vCloud lb pool: %s", err.Error())
-		}
-		if errors.Is(err, ErrNotFound) {
-			// Create Pool first
-			pool, err = loadBalancer.CreatePool(&types.LbPool{
+		poolName := loadBalancer.getPoolName(ctx, clusterName, service, port)
+		members, err := loadBalancer.desiredPoolMembers(port, service, nodes)
+		if err != nil {
+			return nil, fmt.Errorf("error creating vCloud lb pool member: %s", err.Error())
+		}
+
+		pool, err := findPool(clusterName, edge.Pools, owner, poolName, legacyPoolName(clusterName, service, port.NodePort))
+		if errors.Is(err, ErrForeignObject) {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to modify pool: %s", err.Error())
+			return nil, err
+		}
+		if pool == nil {
+			pool, err = edge.CreatePool(&types.LbPool{
 				Name:                poolName,
-				Description:         PoolDescription,
+				Description:         owner.describe(PoolDescription),
 				Algorithm:           getStringFromServiceAnnotation(service, LoadBalancerPoolAlgorithm, string(ROUND_ROBIN)),
 				AlgorithmParameters: "",
 				Transparent:         false,
 				MonitorId:           "",
-				Members:             nil,
+				Members:             members,
 			})
 			if err != nil {
+				loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonPoolFailed, "Creating pool %s failed: %s", poolName, err.Error())
 				return nil, fmt.Errorf("error creating vCloud lb pool: %s", err.Error())
 			}
-		}
-		// For every Port in the Service Configuration
-		for _, node := range nodes {
-			if node.Labels[IsWorkerNode] == "true" {
-				//TODO: implement service monitors
-				member, err := loadBalancer.createMember(port, service, node)
+			loadBalancer.recordEvent(service, corev1.EventTypeNormal, EventReasonPoolCreated, "Created pool %s with %d members", poolName, len(members))
+		} else {
+			var membersChanged bool
+			pool.Members, membersChanged = reconcilePoolMembers(pool.Members, members)
+			//NOTE: Pools created by older releases are renamed and tagged with their owner here
+			if membersChanged || pool.Name != poolName || pool.Description != owner.describe(PoolDescription) {
+				pool.Name = poolName
+				pool.Description = owner.describe(PoolDescription)
+				pool, err = edge.UpdatePool(pool)
 				if err != nil {
-					return nil, fmt.Errorf("error creating vCloud lb pool member: %s", err.Error())
-				}
-
-				if !memberExists(pool.Members, member) {
-					pool.Members = append(pool.Members, *member)
-					poolUpdateRequired = true
+					loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonPoolFailed, "Updating pool %s failed: %s", poolName, err.Error())
+					return nil, fmt.Errorf("error updating vCloud lb pool: %s", err.Error())
 				}
 			}
 		}
 
-		//NOTE: Update the Pool with the new Config if necessary
-		if poolUpdateRequired {
-			_, err = loadBalancer.UpdatePool(pool)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("error updating vCloud lb pool: %s", err.Error())
-		}
-
 		//NOTE: For each ServicePort we need a new vServer
-		//Extend serviceName by unique NodePort since we have to have multiple vServer
-		lbName := fmt.Sprintf("%s-%d", serviceName, port.NodePort)
-		lb, err = loadBalancer.GetLoadBalancerByName(lbName)
-		if err != nil && !errors.Is(err, ErrNotFound) {
-			return nil, fmt.Errorf("error fetching lb by name: %s err:%s", serviceName, err.Error())
+		lbName := virtualServerName(clusterName, service, port)
+		lb, err = findVirtualServer(clusterName, edge.VirtualServers, owner, lbName, legacyVirtualServerName(clusterName, service, port.NodePort))
+		if errors.Is(err, ErrForeignObject) {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to modify virtual server: %s", err.Error())
+			return nil, err
 		}
-
-		if errors.Is(err, ErrNotFound) {
+		if lb == nil {
 			klog.V(4).Infof("Creating loadBalancer with name: %s", lbName)
 
-			lb, err = loadBalancer.CreateVirtualServer(lbName, vServerIP, HTTP, int(port.Port), "ingress", pool.Name)
+			appProfile, err := edge.AppProfileByName("ingress")
 			if err != nil {
 				return nil, fmt.Errorf("failed creating virtual Server err: %s", err.Error())
 			}
-		}
-	}
 
-	//NOTE: Create Firewall Rule for external loadBalancers
-	if getStringFromServiceAnnotation(service, LoadBalancerType, "internal") == "external" {
-		_, err := loadBalancer.GetFirewallRule(serviceName)
-		if errors.Is(err, ErrNotFound) {
-			var services []types.EdgeFirewallApplicationService
-			for _, port := range ports {
-				services = append(services, types.EdgeFirewallApplicationService{
-					Protocol:   "TCP",
-					Port:       strconv.Itoa(int(port.Port)),
-					SourcePort: "any",
-				})
-			}
-			klog.V(4).Infof("Creating NSXV Rule at: %s", time.Now().Format(time.RFC850))
-			err = loadBalancer.createFirewallRule(&FirewallConfig{
-				name: serviceName,
-				Source: types.EdgeFirewallEndpoint{
-					IpAddresses: []string{"any"},
-				},
-				Destination: types.EdgeFirewallEndpoint{IpAddresses: []string{lb.IpAddress}},
-				Application: types.EdgeFirewallApplication{Services: services},
+			//TODO: Add support for configuring connection limits.
+			lb, err = edge.CreateVirtualServer(&types.LbVirtualServer{
+				Name:                 lbName,
+				Description:          owner.describe(VirtualServerDescription),
+				Enabled:              true,
+				IpAddress:            vServerIP,
+				Protocol:             string(HTTP),
+				Port:                 int(port.Port),
+				ApplicationProfileId: appProfile.ID,
+				DefaultPoolId:        pool.ID,
 			})
 			if err != nil {
-				return nil, fmt.Errorf("error creating NSXV Firewall Rule: %s", err.Error())
+				loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonVirtualServerFailed, "Creating virtual server %s failed: %s", lbName, err.Error())
+				return nil, fmt.Errorf("failed creating virtual Server err: %s", err.Error())
 			}
+			loadBalancer.recordEvent(service, corev1.EventTypeNormal, EventReasonVirtualServerCreated, "Created virtual server %s on %s:%d", lbName, vServerIP, port.Port)
+		} else if lb.Name != lbName || lb.Description != owner.describe(VirtualServerDescription) || lb.IpAddress != vServerIP || lb.Port != int(port.Port) || lb.DefaultPoolId != pool.ID {
+			klog.V(4).Infof("Updating loadBalancer with name: %s", lbName)
+
+			lb.Name = lbName
+			lb.Description = owner.describe(VirtualServerDescription)
+			lb.IpAddress = vServerIP
+			lb.Port = int(port.Port)
+			lb.DefaultPoolId = pool.ID
+			lb, err = edge.UpdateVirtualServer(lb)
+			if err != nil {
+				loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonVirtualServerFailed, "Updating virtual server %s failed: %s", lbName, err.Error())
+				return nil, fmt.Errorf("failed updating virtual Server err: %s", err.Error())
+			}
+		}
+	}
+
+	releaseNetwork()
+	releaseNetwork = func() {}
+
+	//NOTE: Remove vServers and pools of ServicePorts that are no longer part of the Service
+	err = loadBalancer.deleteStaleObjects(clusterName, edge, service)
+	if err != nil {
+		return nil, err
+	}
+
+	//NOTE: NAT rules, firewall rules and IP sets are only read if the Service uses them now or did so before
+	applied := loadBalancer.appliedFeatures(service)
+	desired := serviceFeatures{
+		nat:      publicIP != "",
+		firewall: lbType == "external" || lbType == "nat" || loadBalancer.internalFirewall(service),
+		ipSet:    loadBalancer.ipSetName(service) != "",
+	}
+
+	//NOTE: Rules of Services that are no longer of type nat are removed as well
+	if desired.nat || applied.nat {
+		err = loadBalancer.ensureNatRules(clusterName, edge, service, publicIP, vServerIP)
+		if err != nil {
+			return nil, err
 		}
 	}
 
+	//NOTE: The edge firewall matches the original address of DNAT traffic, which is the public IP
+	destination := lb.IpAddress
+	if publicIP != "" {
+		destination = publicIP
+	}
+
+	//NOTE: Create Firewall Rules for external loadBalancers and for internal ones if enabled, otherwise existing rules are removed
+	if lbType == "external" || lbType == "nat" {
+		err = loadBalancer.ensureFirewallRules(clusterName, edge, service, destination, nil)
+	} else if loadBalancer.internalFirewall(service) {
+		err = loadBalancer.ensureFirewallRules(clusterName, edge, service, lb.IpAddress, loadBalancer.vCloud.cfg.Firewall.Internal.Sources)
+	} else if applied.firewall {
+		err = loadBalancer.deleteFirewallRules(clusterName, edge, service, firewallRuleNames(clusterName, service)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if desired.ipSet || applied.ipSet {
+		err = loadBalancer.ensureIPSetMembership(clusterName, edge, service, []string{destination})
+		if err != nil {
+			return nil, err
+		}
+	}
+	loadBalancer.features.Store(service.UID, desired)
+
 	status := &corev1.LoadBalancerStatus{}
 	status.Ingress = []corev1.LoadBalancerIngress{{IP: lb.IpAddress}}
+	if publicIP != "" {
+		status.Ingress = []corev1.LoadBalancerIngress{{IP: publicIP}}
+	}
 
 	return status, nil
 }
 
 func (loadBalancer *LB) UpdateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) error {
+	start := time.Now()
+	err := loadBalancer.updateLoadBalancer(ctx, clusterName, service, nodes)
+	observeReconcile("update", start, err)
+	return err
+}
+
+func (loadBalancer *LB) updateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) error {
 	klog.V(4).Infof("UpdateLoadBalancer: called with clusterName %s", clusterName)
+	loadBalancer.observeClusterName(clusterName)
+	ctx, cancel := loadBalancer.withOperationTimeout(ctx)
+	defer cancel()
 	serviceName := loadBalancer.GetLoadBalancerName(ctx, clusterName, service)
+	unlock, err := loadBalancer.lockService(ctx, service)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	if len(nodes) == 0 {
 		return fmt.Errorf("there are no available nodes for LoadBalancer service %s", serviceName)
@@ -264,72 +516,192 @@ func (loadBalancer *LB) UpdateLoadBalancer(ctx context.Context, clusterName stri
 		return fmt.Errorf("no ports provided to vCloud load balancer")
 	}
 
-	pool, err := loadBalancer.GetLoadBalancerPool(serviceName)
+	edge, err := loadBalancer.readEdgeLoadBalancer(ctx)
 	if err != nil {
-		return fmt.Errorf("error retrieving vCloud lb pool: %s", err.Error())
+		return fmt.Errorf("error retrieving vCloud lb configuration: %s", err.Error())
 	}
+	defer edge.logRequests("UpdateLoadBalancer", serviceName)
+	defer edge.recordManagedObjects(clusterName)
 
 	for _, port := range ports {
+		pool, err := findPool(clusterName, edge.Pools, ownerFor(clusterName, service, port),
+			loadBalancer.getPoolName(ctx, clusterName, service, port),
+			legacyPoolName(clusterName, service, port.NodePort))
+		if errors.Is(err, ErrForeignObject) {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Refusing to modify pool: %s", err.Error())
+			return err
+		}
+		if pool == nil {
+			return fmt.Errorf("error retrieving vCloud lb pool for port %s: %w", portKey(port), ErrNotFound)
+		}
 
 		//Check all members
-		for _, node := range nodes {
-			if node.Labels[IsWorkerNode] == "true" {
-
-				member, err := loadBalancer.createMember(port, service, node)
-				if err != nil {
-					return fmt.Errorf("error creating vCloud lb pool member: %s", err.Error())
-				}
-
-				if !memberExists(pool.Members, member) {
-					pool.Members = append(pool.Members, *member)
-				}
-			}
+		members, err := loadBalancer.desiredPoolMembers(port, service, nodes)
+		if err != nil {
+			return fmt.Errorf("error creating vCloud lb pool member: %s", err.Error())
 		}
 
-	}
+		var membersChanged bool
+		pool.Members, membersChanged = reconcilePoolMembers(pool.Members, members)
+		if !membersChanged {
+			continue
+		}
 
-	_, err = loadBalancer.UpdatePool(pool)
-	if err != nil {
-		return fmt.Errorf("error updating vCloud lb pool: %s", err.Error())
+		_, err = edge.UpdatePool(pool)
+		if err != nil {
+			loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonPoolFailed, "Updating pool %s failed: %s", pool.Name, err.Error())
+			return fmt.Errorf("error updating vCloud lb pool: %s", err.Error())
+		}
 	}
 
 	return nil
 }
 
 func (loadBalancer *LB) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *corev1.Service) error {
+	start := time.Now()
+	err := loadBalancer.ensureLoadBalancerDeleted(ctx, clusterName, service)
+	observeReconcile("delete", start, err)
+	return err
+}
+
+func (loadBalancer *LB) ensureLoadBalancerDeleted(ctx context.Context, clusterName string, service *corev1.Service) error {
 	klog.V(4).Infof("EnsureLoadBalancerDeleted: called with clusterName %s", clusterName)
+	loadBalancer.observeClusterName(clusterName)
+	ctx, cancel := loadBalancer.withOperationTimeout(ctx)
+	defer cancel()
 	serviceName := loadBalancer.GetLoadBalancerName(ctx, clusterName, service)
+	unlock, err := loadBalancer.lockService(ctx, service)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	loadBalancer.features.Delete(service.UID)
 
-	ports := service.Spec.Ports
+	edge, err := loadBalancer.readEdgeLoadBalancer(ctx)
+	if err != nil {
+		return fmt.Errorf("error retrieving vCloud lb configuration: %s", err.Error())
+	}
+	defer edge.logRequests("EnsureLoadBalancerDeleted", serviceName)
+	defer edge.recordManagedObjects(clusterName)
 
-	//Delete all lb virtual servers
-	for _, port := range ports {
-		lbName := fmt.Sprintf("%s-%d", serviceName, port.NodePort)
-		lb, err := loadBalancer.GetLoadBalancerByName(lbName)
-		if err != nil {
-			return fmt.Errorf("error retrieving vCloud virtual load balancer Server")
+	//NOTE: Objects are matched by their owner, objects of older releases by the names derived from the current ports
+	var vserverNames, poolNames []string
+	for _, port := range service.Spec.Ports {
+		vserverNames = append(vserverNames, legacyVirtualServerName(clusterName, service, port.NodePort))
+		poolNames = append(poolNames, legacyPoolName(clusterName, service, port.NodePort))
+	}
+
+	//NOTE: The addresses are collected before the vServers are gone, they are removed from the IP sets afterwards
+	var addresses []string
+	if publicIP := natPublicIP(service); publicIP != "" {
+		addresses = append(addresses, publicIP)
+	}
+
+	//Delete all lb virtual servers first, pools can not be deleted while they are in use
+	for _, lb := range edge.VirtualServers {
+		if !isOwnedBy(clusterName, lb.Description, service) && !loadBalancer.isDeletableByName(clusterName, service, vserverNames, lb.Name, lb.Description) {
+			continue
 		}
-		err = loadBalancer.DeleteLbVirtualServerById(lb.ID)
+		addresses = append(addresses, lb.IpAddress)
+		err = edge.DeleteVirtualServer(lb.ID)
 		if err != nil {
 			return fmt.Errorf("error deleting lb virtual server err:%s", err.Error())
 		}
 	}
 
-	pool, err := loadBalancer.GetLoadBalancerPool(serviceName)
+	for _, pool := range edge.Pools {
+		if !isOwnedBy(clusterName, pool.Description, service) && !loadBalancer.isDeletableByName(clusterName, service, poolNames, pool.Name, pool.Description) {
+			continue
+		}
+		err = edge.DeletePool(pool.ID)
+		if err != nil {
+			return fmt.Errorf("error deleting lb server pool err:%s", err.Error())
+		}
+	}
+
+	err = loadBalancer.ensureNatRules(clusterName, edge, service, "", "")
 	if err != nil {
-		return fmt.Errorf("error retrieving vCloud lb server pool: %s", err.Error())
+		return err
 	}
 
-	err = loadBalancer.DeleteLbServerPoolById(pool.ID)
+	err = loadBalancer.deleteFirewallRules(clusterName, edge, service, firewallRuleNames(clusterName, service)...)
 	if err != nil {
-		return fmt.Errorf("error deleting lb server pool err:%s", err.Error())
+		return err
 	}
 
-	rule, err := loadBalancer.GetFirewallRule(serviceName)
-	if !errors.Is(err, ErrNotFound) {
-		_, err := loadBalancer.DeleteFirewallRule(rule)
+	return loadBalancer.removeFromIPSets(clusterName, edge, service, addresses)
+}
+
+//isDeletableByName reports whether an object that matches one of the names of the Service may be deleted.
+//Objects of other clusters are never deleted, a warning event is emitted instead.
+func (loadBalancer *LB) isDeletableByName(clusterName string, service *corev1.Service, names []string, name string, description string) bool {
+	if !contains(names, name) {
+		return false
+	}
+	if err := checkOwnership(clusterName, name, description); err != nil {
+		loadBalancer.recordEvent(service, corev1.EventTypeWarning, EventReasonNameCollision, "Not deleting object: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+//findServiceVirtualServers returns the vServers of all current ServicePorts that already exist
+func findServiceVirtualServers(vservers []*types.LbVirtualServer, clusterName string, service *corev1.Service) []*types.LbVirtualServer {
+	var found []*types.LbVirtualServer
+	for _, port := range service.Spec.Ports {
+		//NOTE: Foreign objects are ignored here, they are reported when the port is reconciled
+		vserver, _ := findVirtualServer(clusterName, vservers, ownerFor(clusterName, service, port),
+			virtualServerName(clusterName, service, port),
+			legacyVirtualServerName(clusterName, service, port.NodePort))
+		if vserver != nil {
+			found = append(found, vserver)
+		}
+	}
+	return found
+}
+
+//ownedVirtualServers returns all vServers tagged with the UID of the given Service
+func ownedVirtualServers(clusterName string, vservers []*types.LbVirtualServer, service *corev1.Service) []*types.LbVirtualServer {
+	var owned []*types.LbVirtualServer
+	for _, vserver := range vservers {
+		if isOwnedBy(clusterName, vserver.Description, service) {
+			owned = append(owned, vserver)
+		}
+	}
+	return owned
+}
+
+//deleteStaleObjects removes vServers and pools owned by the Service whose ServicePort no longer exists
+func (loadBalancer *LB) deleteStaleObjects(clusterName string, edge *edgeLoadBalancer, service *corev1.Service) error {
+	var ports []string
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, portKey(port))
+	}
+
+	for _, vserver := range ownedVirtualServers(clusterName, edge.VirtualServers, service) {
+		owner, _ := parseOwner(vserver.Description)
+		if contains(ports, owner.Port) {
+			continue
+		}
+		klog.V(4).Infof("Deleting stale loadBalancer with name: %s", vserver.Name)
+		err := edge.DeleteVirtualServer(vserver.ID)
+		if err != nil {
+			return fmt.Errorf("error deleting stale lb virtual server err:%s", err.Error())
+		}
+	}
+
+	for _, pool := range edge.Pools {
+		if !isOwnedBy(clusterName, pool.Description, service) {
+			continue
+		}
+		owner, _ := parseOwner(pool.Description)
+		if contains(ports, owner.Port) {
+			continue
+		}
+		klog.V(4).Infof("Deleting stale pool with name: %s", pool.Name)
+		err := edge.DeletePool(pool.ID)
 		if err != nil {
-			return fmt.Errorf("error deleting nsxv firewall rule err:%s", err.Error())
+			return fmt.Errorf("error deleting stale lb server pool err:%s", err.Error())
 		}
 	}
 
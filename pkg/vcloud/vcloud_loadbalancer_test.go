@@ -0,0 +1,402 @@
+package vcloud
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/go-vcloud-director/v2/types/v56"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestLoadBalancerRequests pins the requests every call sends to vCloud, a steady Service must not cause writes
+func TestLoadBalancerRequests(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+	ctx := context.Background()
+	service := testService("web", 80, 443)
+	nodes := testNodes("10.13.37.21", "10.13.37.22")
+
+	edge := f.edgePath()
+	readLB := "GET " + edge + types.LbConfigPath
+	readNAT := "GET " + edge + "/nat/config"
+	readFirewall := "GET " + edge + "/firewall/config"
+	readIPSets := "GET /network/services/ipset/scope/" + fakeVDCID
+
+	//NOTE: Logs in and resolves the org, VDC and edge so they are not part of the counted requests
+	if _, _, err := lb.GetLoadBalancer(ctx, "cluster", service); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		call     func() error
+		expected []string
+	}{
+		{
+			name: "create",
+			call: func() error {
+				_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+				return err
+			},
+			//NOTE: Without a record of the Service leftovers of NAT rules, firewall rules and IP sets are looked for once
+			expected: []string{
+				readLB,
+				"GET /api/vdc/" + fakeVDCID,
+				"GET /api/network/" + fakeNetworkID,
+				"GET /api/network/" + fakeNetworkID + "/allocatedAddresses",
+				"POST " + edge + types.LbServerPoolPath,
+				"POST " + edge + types.LbVirtualServerPath,
+				"POST " + edge + types.LbServerPoolPath,
+				"POST " + edge + types.LbVirtualServerPath,
+				readNAT,
+				readFirewall,
+				readIPSets,
+			},
+		},
+		{
+			name: "ensure unchanged",
+			call: func() error {
+				_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+				return err
+			},
+			expected: []string{readLB},
+		},
+		{
+			name: "update unchanged",
+			call: func() error {
+				return lb.UpdateLoadBalancer(ctx, "cluster", service, nodes)
+			},
+			expected: []string{readLB},
+		},
+		{
+			name: "update with replaced node",
+			call: func() error {
+				return lb.UpdateLoadBalancer(ctx, "cluster", service, testNodes("10.13.37.21", "10.13.37.23"))
+			},
+			expected: []string{
+				readLB,
+				"PUT " + edge + types.LbServerPoolPath + "pool-1",
+				"PUT " + edge + types.LbServerPoolPath + "pool-3",
+			},
+		},
+		{
+			name: "ensure after update",
+			call: func() error {
+				_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, testNodes("10.13.37.21", "10.13.37.23"))
+				return err
+			},
+			expected: []string{readLB},
+		},
+		{
+			name: "ensure after restart",
+			call: func() error {
+				lb.features.Range(func(key, _ interface{}) bool {
+					lb.features.Delete(key)
+					return true
+				})
+				_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, testNodes("10.13.37.21", "10.13.37.23"))
+				return err
+			},
+			expected: []string{readLB, readNAT, readFirewall, readIPSets},
+		},
+		{
+			name: "delete",
+			call: func() error {
+				return lb.EnsureLoadBalancerDeleted(ctx, "cluster", service)
+			},
+			expected: []string{
+				readLB,
+				"DELETE " + edge + types.LbVirtualServerPath + "virtualServer-2",
+				"DELETE " + edge + types.LbVirtualServerPath + "virtualServer-4",
+				"DELETE " + edge + types.LbServerPoolPath + "pool-1",
+				"DELETE " + edge + types.LbServerPoolPath + "pool-3",
+				readNAT,
+				readFirewall,
+				readIPSets,
+			},
+		},
+		{
+			name: "delete again",
+			call: func() error {
+				return lb.EnsureLoadBalancerDeleted(ctx, "cluster", service)
+			},
+			expected: []string{readLB, readNAT, readFirewall},
+		},
+	}
+
+	for _, test := range tests {
+		f.resetRequests()
+		if err := test.call(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if requests := f.Requests(); !reflect.DeepEqual(requests, test.expected) {
+			t.Errorf("%s: expected %d requests, got %d:\n%s", test.name, len(test.expected), len(requests), strings.Join(requests, "\n"))
+		}
+	}
+}
+
+// TestConcurrentReconciles runs reconciles of several Services on one edge in parallel, run it with -race
+func TestConcurrentReconciles(t *testing.T) {
+	f := newFakeVCD(t)
+	f.writeDelay = 2 * time.Millisecond
+	lb := newFakeLB(t, f, nil)
+	ctx := context.Background()
+	nodes := testNodes("10.13.37.201", "10.13.37.202")
+	updatedNodes := testNodes("10.13.37.201", "10.13.37.203")
+
+	var services []*corev1.Service
+	for i := 0; i < 6; i++ {
+		services = append(services, testService("web-"+strconv.Itoa(i), 80, 443))
+	}
+	kept, deleted := services[:3], services[3:]
+
+	run := func(calls ...func() error) {
+		t.Helper()
+		errs := make(chan error, len(calls))
+		var wg sync.WaitGroup
+		for _, call := range calls {
+			wg.Add(1)
+			go func(call func() error) {
+				defer wg.Done()
+				errs <- call()
+			}(call)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ensure := func(service *corev1.Service, nodes []*corev1.Node) func() error {
+		return func() error {
+			_, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes)
+			return err
+		}
+	}
+
+	//NOTE: Every Service is ensured twice at the same time, both reconciles must end up with the same objects
+	var calls []func() error
+	for _, service := range services {
+		calls = append(calls, ensure(service, nodes), ensure(service, nodes))
+	}
+	run(calls...)
+
+	calls = nil
+	for _, service := range kept {
+		service := service
+		calls = append(calls, ensure(service, nodes), func() error {
+			return lb.UpdateLoadBalancer(ctx, "cluster", service, updatedNodes)
+		})
+	}
+	for _, service := range deleted {
+		service := service
+		calls = append(calls, func() error {
+			return lb.EnsureLoadBalancerDeleted(ctx, "cluster", service)
+		})
+	}
+	run(calls...)
+	//NOTE: The order of the Ensure and Update above is random, this settles the members
+	calls = nil
+	for _, service := range kept {
+		service := service
+		calls = append(calls, func() error {
+			return lb.UpdateLoadBalancer(ctx, "cluster", service, updatedNodes)
+		})
+	}
+	run(calls...)
+
+	if overlapping := f.overlappingWriteCount(); overlapping > 0 {
+		t.Errorf("expected writes to the edge to be serialized, %d overlapped", overlapping)
+	}
+
+	addresses := map[string]string{}
+	for _, service := range kept {
+		vservers, pools := f.objectsOf("cluster", service)
+		if len(vservers) != 2 || len(pools) != 2 {
+			t.Errorf("%s: expected 2 vServers and 2 pools, got %d and %d", service.Name, len(vservers), len(pools))
+			continue
+		}
+		if vservers[0].IpAddress != vservers[1].IpAddress {
+			t.Errorf("%s: expected all ports on one address, got %s and %s", service.Name, vservers[0].IpAddress, vservers[1].IpAddress)
+		}
+		if other, ok := addresses[vservers[0].IpAddress]; ok {
+			t.Errorf("%s: address %s is also used by %s", service.Name, vservers[0].IpAddress, other)
+		}
+		addresses[vservers[0].IpAddress] = service.Name
+		for _, pool := range pools {
+			if members := memberAddresses(pool); !reflect.DeepEqual(members, []string{"10.13.37.201", "10.13.37.203"}) {
+				t.Errorf("%s: expected pool %s to have the updated members, got %v", service.Name, pool.Name, members)
+			}
+		}
+	}
+	for _, service := range deleted {
+		if vservers, pools := f.objectsOf("cluster", service); len(vservers) > 0 || len(pools) > 0 {
+			t.Errorf("%s: expected no objects after deletion, got %d vServers and %d pools", service.Name, len(vservers), len(pools))
+		}
+	}
+	if vservers, pools := f.VirtualServers(), f.Pools(); len(vservers) != 2*len(kept) || len(pools) != 2*len(kept) {
+		t.Errorf("expected %d vServers and pools on the edge, got %d and %d", 2*len(kept), len(vservers), len(pools))
+	}
+}
+
+func TestFirewallRulesOfOlderReleasesAreRenamed(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, func(cfg *Config) {
+		cfg.Firewall.DenyByDefault = true
+		cfg.Firewall.Internal.Enabled = true
+	})
+	ctx := context.Background()
+	service := testService("web", 80)
+	nodes := testNodes("10.13.37.201")
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	//NOTE: Older releases named the rules after the Service only
+	legacyNames := map[string]string{
+		firewallRuleName("cluster", service):     legacyFirewallRuleName("cluster", service),
+		firewallDenyRuleName("cluster", service): legacyFirewallDenyRuleName("cluster", service),
+	}
+	f.lock.Lock()
+	ids := map[string]string{}
+	for _, rule := range f.firewallRules {
+		if legacy, ok := legacyNames[rule.Name]; ok {
+			ids[rule.Name] = rule.ID
+			rule.Name = legacy
+		}
+	}
+	f.lock.Unlock()
+	if len(ids) != 2 {
+		t.Fatalf("expected an allow and a deny rule, got %v", ids)
+	}
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	rules := f.FirewallRules()
+	if len(rules) != 3 {
+		t.Errorf("expected the rules to be renamed instead of recreated, got %d rules", len(rules))
+	}
+	for _, rule := range rules {
+		if id, ok := ids[rule.Name]; ok && id != rule.ID {
+			t.Errorf("expected rule %s to keep ID %s, got %s", rule.Name, id, rule.ID)
+		}
+		delete(ids, rule.Name)
+	}
+	if len(ids) > 0 {
+		t.Errorf("expected the rules to be renamed, missing %v", ids)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+		t.Fatal(err)
+	}
+	if rules := f.FirewallRules(); len(rules) != 1 {
+		t.Errorf("expected only the default rule to be left, got %d rules", len(rules))
+	}
+}
+
+// benchmarkReconcile reports the vCloud requests per reconcile of a Service that is already in place
+func benchmarkReconcile(b *testing.B, reconcile func(lb *LB, service *corev1.Service, nodes []*corev1.Node) error) {
+	f := newFakeVCD(b)
+	lb := newFakeLB(b, f, nil)
+	service := testService("web", 80, 443)
+	nodes := testNodes("10.13.37.21", "10.13.37.22")
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "cluster", service, nodes); err != nil {
+		b.Fatal(err)
+	}
+	f.resetRequests()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := reconcile(lb, service, nodes); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(len(f.Requests()))/float64(b.N), "requests/op")
+}
+
+func BenchmarkEnsureLoadBalancer(b *testing.B) {
+	benchmarkReconcile(b, func(lb *LB, service *corev1.Service, nodes []*corev1.Node) error {
+		_, err := lb.EnsureLoadBalancer(context.Background(), "cluster", service, nodes)
+		return err
+	})
+}
+
+func BenchmarkUpdateLoadBalancer(b *testing.B) {
+	benchmarkReconcile(b, func(lb *LB, service *corev1.Service, nodes []*corev1.Node) error {
+		return lb.UpdateLoadBalancer(context.Background(), "cluster", service, nodes)
+	})
+}
+
+func TestFeaturesTurnedOffAreCleanedUp(t *testing.T) {
+	f := newFakeVCD(t)
+	lb := newFakeLB(t, f, nil)
+	ctx := context.Background()
+	service := testService("web", 80)
+	service.Annotations = map[string]string{LoadBalancerFirewallInternal: "true"}
+	nodes := testNodes("10.13.37.201")
+
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if rules := f.FirewallRules(); len(rules) != 2 {
+		t.Fatalf("expected the firewall rule of the Service, got %d rules", len(rules))
+	}
+
+	//NOTE: The rule is only found because the Service used a firewall rule before
+	delete(service.Annotations, LoadBalancerFirewallInternal)
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if rules := f.FirewallRules(); len(rules) != 1 {
+		t.Errorf("expected the firewall rule to be deleted, got %d rules", len(rules))
+	}
+
+	f.resetRequests()
+	if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if requests := f.Requests(); len(requests) != 1 {
+		t.Errorf("expected only the load balancer configuration to be read, got %v", requests)
+	}
+}
+
+func TestIPSetsThatCanNotBeRead(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			f := newFakeVCD(t)
+			lb := newFakeLB(t, f, nil)
+			ctx := context.Background()
+			f.setIntercept(func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/network/services/ipset/scope/"+fakeVDCID) {
+					return false
+				}
+				writeVCDError(w, status, "Either you need some or all of the following rights [Organization vDC Network: View Properties]")
+				return true
+			})
+
+			service := testService("web", 80)
+			if _, err := lb.EnsureLoadBalancer(ctx, "cluster", service, testNodes("10.13.37.201")); err != nil {
+				t.Fatalf("expected a Service without IP set to be ensured, got %s", err)
+			}
+			if err := lb.EnsureLoadBalancerDeleted(ctx, "cluster", service); err != nil {
+				t.Fatalf("expected a Service without IP set to be deleted, got %s", err)
+			}
+
+			grouped := testService("grouped", 80)
+			grouped.Annotations = map[string]string{LoadBalancerFirewallIPSet: "kube_ipset"}
+			if _, err := lb.EnsureLoadBalancer(ctx, "cluster", grouped, testNodes("10.13.37.201")); err == nil {
+				t.Errorf("expected a Service with IP set to fail")
+			}
+		})
+	}
+}
@@ -1,169 +1,187 @@
 package vcloud
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/vmware/go-vcloud-director/v2/govcd"
 	"github.com/vmware/go-vcloud-director/v2/types/v56"
-	"io/ioutil"
 	"k8s.io/klog"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 const (
 	VirtualServerDescription string = "This Service was automatically created and managed by vCloud-cloud-controller-manager"
 	PoolDescription          string = "This Pool was automatically created and managed by vCloud-cloud-controller-manager"
+	NatRuleDescription       string = "This NAT Rule was automatically created and managed by vCloud-cloud-controller-manager"
+	IPSetDescription         string = "This IP Set was automatically created and managed by vCloud-cloud-controller-manager"
 )
 
 var (
 	ErrNotFound           = errors.New("not found")
 	cachedVCDClients      = &cacheStorage{conMap: make(map[string]cachedConnection)}
 	maxConnectionValidity = 20 * time.Minute
+	cachedVCDObjects      = newObjectCache(maxObjectValidity)
+	maxObjectValidity     = 5 * time.Minute
+
+	defaultRequestTimeout   = time.Minute
+	defaultOperationTimeout = 5 * time.Minute
 )
 
-func (v *vCloud) getClient(forceRefresh bool) (*govcd.VCDClient, error) {
+// withOperationTimeout bounds a whole operation of the load balancer including locks and retries
+func (loadBalancer *LB) withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, loadBalancer.vCloud.cfg.Timeouts.Operation.Duration)
+}
+
+func (v *vCloud) getClient(ctx context.Context, forceRefresh bool) (*govcd.VCDClient, error) {
 	klog.Infof("getClient() called")
-	rawData := v.cfg.User + "#" +
-		v.cfg.Password + "#" +
+	//NOTE: The key identifies the session owner, secrets are deliberately not part of it
+	rawData := v.authMethod() + "#" +
+		v.credentials().User + "#" +
 		v.cfg.VDC + "#" +
 		v.cfg.Org + "#" +
 		v.cfg.Href
 	checksum := fmt.Sprintf("%x", sha1.Sum([]byte(rawData)))
 
+	sessionTTL := v.cfg.SessionTTL.Duration
+	if sessionTTL <= 0 {
+		sessionTTL = maxConnectionValidity
+	}
+
 	//LOCK
 	cachedVCDClients.Lock()
 	client, ok := cachedVCDClients.conMap[checksum]
 	cachedVCDClients.Unlock()
+	var replaced *govcd.VCDClient
+	loginReason := "initial"
 	if ok {
 		cachedVCDClients.Lock()
 		cachedVCDClients.cacheClientServedCount += 1
 		cachedVCDClients.Unlock()
 		elapsed := time.Since(client.initTime)
 		// Delete cached Connection when forcing a Refresh
-		if (elapsed > maxConnectionValidity) || forceRefresh {
-			klog.V(5).Infof("cached connection invalidated after %2.0f minutes \n", maxConnectionValidity.Minutes())
+		expired := !client.expiresAt.IsZero() && time.Now().After(client.expiresAt)
+		switch {
+		case forceRefresh:
+			loginReason = "rejected"
+		case expired:
+			loginReason = "token_expired"
+		case elapsed > sessionTTL:
+			loginReason = "session_ttl"
+		}
+		if (elapsed > sessionTTL) || expired || forceRefresh {
+			klog.V(5).Infof("cached connection invalidated after %2.0f minutes \n", elapsed.Minutes())
 			cachedVCDClients.Lock()
 			delete(cachedVCDClients.conMap, checksum)
 			cachedVCDClients.Unlock()
+			cachedVCDObjects.invalidate("session refreshed")
+			replaced = client.connection
 		} else {
+			sessionCacheRequests.WithLabelValues("hit").Inc()
 			return client.connection, nil
 		}
 	}
+	sessionCacheRequests.WithLabelValues("miss").Inc()
 
 	u, err := url.ParseRequestURI(v.cfg.Href)
 	if err != nil {
 		return nil, fmt.Errorf("unable to pass url: %s", err)
 	}
 
-	vcdclient := govcd.NewVCDClient(*u, v.cfg.Insecure)
+	transport, err := v.newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	vcdclient := govcd.NewVCDClient(*u, v.cfg.Insecure, withTransport(transport), withTimeout(v.cfg.Timeouts.Request.Duration))
 	klog.V(4).Info("Logging into vCloud")
-	err = vcdclient.Authenticate(v.cfg.User, v.cfg.Password, v.cfg.Org)
+	logins.WithLabelValues(loginReason).Inc()
+	var validity time.Duration
+	err = observeAPICall("login", func() error {
+		var err error
+		validity, err = v.authenticate(ctx, vcdclient)
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to authenticate: %s", err)
 	}
 
+	connection := cachedConnection{initTime: time.Now(), connection: vcdclient}
+	if validity > time.Minute {
+		// Renew a minute early so requests do not race with the expiry of the token
+		connection.expiresAt = connection.initTime.Add(validity - time.Minute)
+	}
 	cachedVCDClients.Lock()
-	cachedVCDClients.conMap[checksum] = cachedConnection{initTime: time.Now(), connection: vcdclient}
+	cachedVCDClients.conMap[checksum] = connection
 	cachedVCDClients.Unlock()
 
+	if replaced != nil && v.ownsSession() {
+		logout(replaced)
+	}
+
 	return vcdclient, nil
 }
 
-func (loadBalancer *LB) GetLoadBalancerByName(name string) (*types.LbVirtualServer, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
+// renewClient logs in again after rejected was refused by vCloud. If another caller already replaced
+// the rejected session the new one is returned, so concurrent failures cause only one login.
+func (v *vCloud) renewClient(ctx context.Context, rejected *govcd.VCDClient) (*govcd.VCDClient, error) {
+	client, err := v.getClient(ctx, false)
 	if err != nil {
 		return nil, err
 	}
-	vservers, err := gateway.GetLbVirtualServers()
-	if err != nil {
-		return nil, err
+	if client != rejected {
+		return client, nil
 	}
-	for _, vserver := range vservers {
-		if vserver.Name == name {
-			return vserver, nil
-		}
-	}
-	return nil, ErrNotFound
+	klog.V(2).Info("vCloud session was rejected, logging in again")
+	return v.getClient(ctx, true)
 }
 
-func (loadBalancer *LB) GetLoadBalancerPool(name string) (*types.LbPool, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
+// withRenewedSession runs fn with the cached session and repeats it once with a new session if vCloud rejected it
+func (v *vCloud) withRenewedSession(ctx context.Context, fn func(client *govcd.VCDClient) error) error {
+	client, err := v.getClient(ctx, false)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	pools, err := gateway.GetLbServerPools()
-	if err != nil {
-		return nil, err
+	err = fn(client)
+	if !isUnauthorizedError(err) {
+		return err
 	}
-	for _, pool := range pools {
-		if pool.Name == name {
-			return pool, nil
-		}
+	client, err = v.renewClient(ctx, client)
+	if err != nil {
+		return err
 	}
-	return nil, ErrNotFound
+	return fn(client)
 }
 
-func (loadBalancer *LB) CreatePool(pool *types.LbPool) (*types.LbPool, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return nil, err
-	}
-	pool, err = gateway.CreateLbServerPool(pool)
-	if err != nil {
-		return nil, err
+// logout ends a session that is no longer used so it does not count against the session limit of the user
+func logout(client *govcd.VCDClient) {
+	if err := client.Disconnect(); err != nil {
+		klog.V(4).Infof("Logging out of replaced vCloud session failed: %s", err.Error())
 	}
-
-	return pool, nil
 }
 
-func (loadBalancer *LB) UpdatePool(pool *types.LbPool) (*types.LbPool, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return nil, err
-	}
-	pool, err = gateway.UpdateLbServerPool(pool)
-	if err != nil {
-		return nil, err
-	}
-	return pool, nil
+// isUnauthorizedError reports whether vCloud rejected the session of a request
+func isUnauthorizedError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:", http.StatusUnauthorized))
 }
 
-func (loadBalancer *LB) CreateVirtualServer(name string, ip string, protocol LbProtocol, port int, applicationProfile string, poolName string) (*types.LbVirtualServer, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return nil, err
-	}
-	lbAppProfile, err := gateway.GetLbAppProfileByName(applicationProfile)
-	if err != nil {
-		return nil, err
+// hasAPIStatus reports whether vCloud answered the request with one of the given HTTP statuses
+func hasAPIStatus(err error, statuses ...int) bool {
+	if err == nil {
+		return false
 	}
-
-	lbPool, err := loadBalancer.GetLoadBalancerPool(poolName)
-	if err != nil {
-		return nil, err
+	for _, status := range statuses {
+		if strings.Contains(err.Error(), fmt.Sprintf("API Error: %d:", status)) {
+			return true
+		}
 	}
-
-	//TODO: Add support for configuring connection limits.
-	vServer, err := gateway.CreateLbVirtualServer(&types.LbVirtualServer{
-		Name:                 name,
-		Description:          VirtualServerDescription,
-		Enabled:              true,
-		IpAddress:            ip,
-		Protocol:             string(protocol),
-		Port:                 port,
-		ConnectionLimit:      0,
-		ConnectionRateLimit:  0,
-		ApplicationProfileId: lbAppProfile.ID,
-		DefaultPoolId:        lbPool.ID,
-	})
-
-	return vServer, nil
+	return false
 }
 
 func (loadBalancer *LB) getPublicIPAddressesFromEdgeGateway(gateway *govcd.EdgeGateway) (string, string, error) {
@@ -173,12 +191,13 @@ func (loadBalancer *LB) getPublicIPAddressesFromEdgeGateway(gateway *govcd.EdgeG
 	return startPublicAddress, endPublicAddress, nil
 }
 
-func (loadBalancer *LB) GetNextAvailableIpAddressInVCloudNet(networkName string, ipnet string) (string, error) {
-	allocatedIps, err := loadBalancer.vCloud.getAllocatedIPAddresses(networkName)
+// GetNextAvailableIpAddressInVCloudNet returns the first address of ipnet that is neither allocated in vCloud nor in inUse
+func (loadBalancer *LB) GetNextAvailableIpAddressInVCloudNet(ctx context.Context, networkName string, ipnet string, inUse []string) (string, error) {
+	allocatedIps, err := loadBalancer.vCloud.getAllocatedIPAddresses(ctx, networkName)
 	if err != nil {
 		return "", err
 	}
-	var ips []string
+	ips := append([]string(nil), inUse...)
 
 	for _, ip := range allocatedIps.IpAddress {
 		ips = append(ips, ip.IpAddress)
@@ -194,201 +213,192 @@ func (loadBalancer *LB) GetNextAvailableIpAddressInVCloudNet(networkName string,
 
 	end := (start & mask) | (mask ^ 0xffffffff)
 
+	var free []string
 	for i := start + 1; i <= end-1; i++ {
 		ip := make(net.IP, 4)
 		binary.BigEndian.PutUint32(ip, i)
 
 		if !contains(ips, ip.String()) {
-			return ip.String(), nil
+			free = append(free, ip.String())
 		}
 
 	}
 
-	return "", errors.New("no IP addresses left")
-}
-
-func (v *vCloud) getAllocatedIPAddresses(name string) (*IpAddressAllocation, error) {
-	vclient, err := v.getClient(false)
-	if err != nil {
-		fmt.Println(err)
-	}
-	token := vclient.Client.VCDToken
-	network, err := v.getNetworkByName(name)
-	if err != nil {
-		return nil, err
-	}
-
-	client := &http.Client{Timeout: 30 * time.Second}
-
-	requestUrl := fmt.Sprintf("%s/allocatedAddresses", network.OrgVDCNetwork.HREF)
-
-	req, err := http.NewRequest("GET", requestUrl, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("x-vCloud-authorization", token)
-	req.Header.Add("Accept", fmt.Sprintf("application/*+xml;version=%s", vclient.Client.APIVersion))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	//NOTE: The address handed out now is no longer free
+	if len(free) == 0 {
+		freeAddresses.WithLabelValues(networkName).Set(0)
+		return "", errors.New("no IP addresses left")
 	}
+	freeAddresses.WithLabelValues(networkName).Set(float64(len(free) - 1))
+	return free[0], nil
+}
 
-	//TODO: Check potential errors raised by Close()
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
+func (v *vCloud) getAllocatedIPAddresses(ctx context.Context, name string) (*IpAddressAllocation, error) {
+	network, err := v.getNetworkByName(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
 	var ipAddressAllocation IpAddressAllocation
-
-	err = xml.Unmarshal(body, &ipAddressAllocation)
+	err = v.withRenewedSession(ctx, func(client *govcd.VCDClient) error {
+		return newRESTClient(client, v.cfg.Timeouts.Request.Duration).get(ctx, network.OrgVDCNetwork.HREF+"/allocatedAddresses", &ipAddressAllocation)
+	})
 	if err != nil {
-		return nil, err
+		invalidateOnStaleObject(err)
+		return nil, fmt.Errorf("error fetching allocated addresses of network %s: %w", name, err)
 	}
 
 	return &ipAddressAllocation, nil
 }
 
-func (v *vCloud) getNetworkByName(name string) (*govcd.OrgVDCNetwork, error) {
-	vdc, err := v.getVDC()
-	if err != nil {
-		return nil, err
-	}
-	network, err := vdc.GetOrgVdcNetworkByName(name, true)
+func (v *vCloud) getNetworkByName(ctx context.Context, name string) (*govcd.OrgVDCNetwork, error) {
+	var network *govcd.OrgVDCNetwork
+	//NOTE: The VDC is resolved again after a renewal, the cached one is bound to the rejected session
+	err := v.withRenewedSession(ctx, func(*govcd.VCDClient) error {
+		vdc, err := v.getVDC(ctx)
+		if err != nil {
+			return err
+		}
+		return observeAPICall("get_network", func() error {
+			return callWithContext(ctx, func() error {
+				var err error
+				network, err = vdc.GetOrgVdcNetworkByName(name, true)
+				return err
+			})
+		})
+	})
 	if err != nil {
+		invalidateOnStaleObject(err)
 		klog.Errorf("no such network found with name: %s", name)
 		return nil, err
 	}
 	return network, nil
 }
 
-func (loadBalancer *LB) GetFirewallRule(name string) (*types.EdgeFirewallRule, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return nil, err
+func newFirewallRule(rule *FirewallConfig) *types.EdgeFirewallRule {
+	action := rule.Action
+	if action == "" {
+		action = "Accept"
 	}
-	rules, err := gateway.GetAllNsxvFirewallRules()
-	if err != nil {
-		return nil, err
-	}
-	for _, rule := range rules {
-		if rule.Name == name {
-			return rule, nil
-		}
-	}
-	return nil, ErrNotFound
-}
-
-func (loadBalancer *LB) DeleteLbVirtualServerById(id string) error {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return err
-	}
-	err = gateway.DeleteLbVirtualServerById(id)
-	return err
-}
-
-func (loadBalancer *LB) DeleteLbServerPoolById(id string) error {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return err
-	}
-	err = gateway.DeleteLbServerPoolById(id)
-	return err
-}
-
-func (loadBalancer *LB) DeleteFirewallRule(rule *types.EdgeFirewallRule) (bool, error) {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return false, err
-	}
-	err = gateway.DeleteNsxvFirewallRuleById(rule.ID)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
-}
-
-func (loadBalancer *LB) createFirewallRule(rule *FirewallConfig) error {
-	gateway, err := loadBalancer.getEdgeGateway()
-	if err != nil {
-		return err
-	}
-	_, err = gateway.CreateNsxvFirewallRule(&types.EdgeFirewallRule{
+	return &types.EdgeFirewallRule{
 		Name:           rule.name,
 		RuleType:       "User",
 		Source:         rule.Source,
 		Destination:    rule.Destination,
 		Application:    rule.Application,
-		Action:         "Accept",
+		Action:         action,
 		Enabled:        true,
-		LoggingEnabled: false,
-	}, "")
-	if err != nil {
-		return err
+		LoggingEnabled: rule.LoggingEnabled,
 	}
-
-	return nil
 }
 
-func (v *vCloud) getVDC() (*govcd.Vdc, error) {
-	client, err := v.getClient(false)
-	if err != nil {
-		return nil, err
-	}
-	org, err := client.GetOrgByName(v.cfg.Org)
-	if err != nil {
-		return nil, err
-	}
-	vdc, err := org.GetVDCByName(v.cfg.VDC, true)
+func (v *vCloud) getVDC(ctx context.Context) (*govcd.Vdc, error) {
+	objects, err := v.resolveObjects(ctx, v.cfg.Org, v.cfg.VDC, v.cfg.EdgeGateway, false)
 	if err != nil {
 		return nil, err
 	}
 
-	return vdc, nil
+	return objects.newVDC(), nil
+}
+
+// resolveObjects returns the VDC and Edge Gateway of the load balancer
+func (loadBalancer *LB) resolveObjects(ctx context.Context) (*resolvedObjects, error) {
+	cfg := loadBalancer.vCloud.cfg
+	return loadBalancer.vCloud.resolveObjects(ctx, cfg.Org, cfg.VDC, cfg.EdgeGateway, false)
 }
 
-func (loadBalancer *LB) getEdgeGateway() (*govcd.EdgeGateway, error) {
-	client, err := loadBalancer.vCloud.getClient(false)
+func (v *vCloud) getEdgeGateway(ctx context.Context, orgName string, vdcName string, gatewayName string) (*govcd.EdgeGateway, error) {
+	objects, err := v.resolveObjects(ctx, orgName, vdcName, gatewayName, false)
 	if err != nil {
 		return nil, err
 	}
-	org, err := client.GetOrgByName(loadBalancer.vCloud.cfg.Org)
+
+	return objects.newEdgeGateway(), nil
+}
+
+// resolveObjects returns the VDC and Edge Gateway with the given names. The objects are served from
+// cachedVCDObjects as long as they are valid, forceRefresh resolves them again.
+func (v *vCloud) resolveObjects(ctx context.Context, orgName string, vdcName string, gatewayName string, forceRefresh bool) (*resolvedObjects, error) {
+	client, err := v.getClient(ctx, false)
 	if err != nil {
 		return nil, err
 	}
-	vdc, err := org.GetVDCByName(loadBalancer.vCloud.cfg.VDC, true)
-	if err != nil {
-		return nil, err
+	key := orgName + "/" + vdcName + "/" + gatewayName
+
+	cachedVCDObjects.Lock()
+	if !forceRefresh {
+		if objects, ok := cachedVCDObjects.get(key, client); ok {
+			cachedVCDObjects.Unlock()
+			objectCacheRequests.WithLabelValues("hit").Inc()
+			return objects, nil
+		}
 	}
-	edge, err := vdc.GetEdgeGatewayByName(loadBalancer.vCloud.cfg.EdgeGateway, true)
+	delete(cachedVCDObjects.entries, key)
+	cachedVCDObjects.Unlock()
+	objectCacheRequests.WithLabelValues("miss").Inc()
+
+	var objects *resolvedObjects
+	err = v.withRenewedSession(ctx, func(client *govcd.VCDClient) error {
+		return observeAPICall("resolve_objects", func() error {
+			//NOTE: The lookup may outlive the caller, it only works on objects of its own and leaves the cache alone
+			var vdc *govcd.Vdc
+			var edge *govcd.EdgeGateway
+			err := callWithContext(ctx, func() error {
+				org, err := v.getOrgByName(ctx, client, orgName)
+				if err != nil {
+					return err
+				}
+				vdc, err = org.GetVDCByName(vdcName, true)
+				if err != nil {
+					return err
+				}
+				edge, err = vdc.GetEdgeGatewayByName(gatewayName, true)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			objects = &resolvedObjects{resolvedAt: time.Now(), client: client, vdc: *vdc.Vdc, edge: *edge.EdgeGateway}
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	return edge, nil
+	cachedVCDObjects.Lock()
+	cachedVCDObjects.entries[key] = objects
+	cachedVCDObjects.Unlock()
+	return objects, nil
 }
 
-func (v *vCloud) getEdgeGateway(orgName string, vdcName string, gatewayName string) (*govcd.EdgeGateway, error) {
-	client, err := v.getClient(false)
-	if err != nil {
-		return nil, err
-	}
+// getOrgByName wraps GetOrgByName, which reports every failed lookup as not found. A rejected session
+// is surfaced as such so withRenewedSession renews it instead of failing until the objects are resolved.
+func (v *vCloud) getOrgByName(ctx context.Context, client *govcd.VCDClient, orgName string) (*govcd.Org, error) {
 	org, err := client.GetOrgByName(orgName)
-	if err != nil {
-		return nil, err
+	if err != govcd.ErrorEntityNotFound {
+		return org, err
 	}
-	vdc, err := org.GetVDCByName(vdcName, true)
-	if err != nil {
-		return nil, err
+	orgList := &types.OrgList{}
+	if listErr := newRESTClient(client, v.cfg.Timeouts.Request.Duration).get(ctx, client.Client.VCDHREF.String()+"/org", orgList); listErr != nil {
+		return nil, listErr
 	}
-	edge, err := vdc.GetEdgeGatewayByName(gatewayName, true)
-	if err != nil {
-		return nil, err
+	return nil, err
+}
+
+// isStaleObjectError reports whether an error means the session expired (401) or a cached object is gone (404)
+func isStaleObjectError(err error) bool {
+	if err == nil {
+		return false
 	}
+	message := err.Error()
+	return govcd.ContainsNotFound(err) ||
+		strings.Contains(message, fmt.Sprintf("API Error: %d:", http.StatusUnauthorized)) ||
+		strings.Contains(message, fmt.Sprintf("API Error: %d:", http.StatusNotFound))
+}
 
-	return edge, nil
+// invalidateOnStaleObject drops the cached objects if err indicates they are no longer valid
+func invalidateOnStaleObject(err error) {
+	if isStaleObjectError(err) {
+		cachedVCDObjects.invalidate("stale object")
+	}
 }